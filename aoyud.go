@@ -9,6 +9,7 @@ package main
 import (
 	"fmt"
 	"gopkg.in/alecthomas/kingpin.v1"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -59,6 +60,12 @@ type item struct {
 	sym    string     // Optional symbol name
 	val    string     // Name of the instruction or label. Limited to ASCII characters.
 	params itemParams // Instruction parameters
+	// Parameters of CPU instructions with all aliases expanded.
+	operands itemParams
+	// Generated by the expansion of a macro or repeat block?
+	generated bool
+	// Only evaluated in this pass, as set by IF1 and IF2, or 0 for both.
+	pass int
 }
 
 // itemType identifies the type of lex items.
@@ -117,6 +124,20 @@ type parseFile struct {
 }
 
 func INCLUDE(p *parser, it *item) ErrorList {
+	limit := p.opts.MaxIncludeDepth
+	if limit <= 0 {
+		limit = defaultMaxIncludeDepth
+	}
+	var chain []string
+	for file := p.file; file != nil; file = file.prev {
+		chain = append(chain, *file.name)
+	}
+	if len(chain) > limit {
+		return ErrorListF(ESFatal,
+			"include depth exceeds %d, aborting: %s\n\tincluded from:\n\t%s",
+			limit, it.params[0], strings.Join(chain, "\n\t"),
+		)
+	}
 	return p.StepIntoFile(it.params[0], p.file.paths)
 }
 
@@ -128,8 +149,10 @@ func (p *parser) lexItem(stream *lexStream) (ret *item, err ErrorList) {
 	var pos ItemPos
 	context := KeywordType(0)
 
-	first := stream.nextUntil(insDelim)
+	// Reading the last token of the input moves the position to EOF.
+	stream.ignore(whitespace)
 	pos = append(pos, stream.pos...)
+	first := stream.nextUntil(insDelim)
 	stream.ignore(whitespace)
 
 	// Handle one-char instructions
@@ -152,6 +175,11 @@ func (p *parser) lexItem(stream *lexStream) (ret *item, err ErrorList) {
 	if k, ok := Keywords[firstUpper]; ok {
 		first = firstUpper
 		context = k.Type
+		if p.idealNameFirst(firstUpper) {
+			ret = &item{pos: pos, typ: itemInstruction, sym: second, val: first}
+			stream.nextUntil(insDelim)
+			return p.lexParam(stream, context, ret, err)
+		}
 	} else if k, ok := Keywords[secondUpper]; ok {
 		second = secondUpper
 		context = k.Type
@@ -159,7 +187,7 @@ func (p *parser) lexItem(stream *lexStream) (ret *item, err ErrorList) {
 	} else if val, errLookup := p.syms.Lookup(first); val != nil {
 		err = err.AddLAt(pos, errLookup)
 		switch val.(type) {
-		case asmExpression:
+		case asmExpression, asmText:
 			// TODO: Well, "expressions" can be anything, both syntactically
 			// valid and invalid…
 		case asmStruc:
@@ -174,7 +202,7 @@ func (p *parser) lexItem(stream *lexStream) (ret *item, err ErrorList) {
 	} else if val, errLookup := p.syms.Lookup(second); val != nil {
 		err = err.AddLAt(pos, errLookup)
 		switch val.(type) {
-		case asmStruc:
+		case asmStruc, asmTypedef:
 			context |= SingleParam
 			secondRule = Optional
 		}
@@ -194,6 +222,22 @@ func (p *parser) lexItem(stream *lexStream) (ret *item, err ErrorList) {
 	return p.lexParam(stream, context, ret, err)
 }
 
+// idealNameFirst returns whether the given directive takes its symbol name
+// after the directive itself, as done in TASM's Ideal mode.
+func (p *parser) idealNameFirst(directive string) bool {
+	if !p.ideal {
+		return false
+	}
+	switch directive {
+	case "STRUC", "UNION":
+		// Nested structures already take their name as a parameter.
+		return len(p.strucs) == 0
+	case "PROC", "ENDP", "SEGMENT", "ENDS", "GROUP", "MACRO", "RECORD":
+		return true
+	}
+	return false
+}
+
 // lexParam recursively scans the parameters following the given item from the
 // given stream and adds them to it.
 func (p *parser) lexParam(stream *lexStream, context KeywordType, it *item, err ErrorList) (*item, ErrorList) {
@@ -244,6 +288,7 @@ func (p *parser) StepIntoFile(filename string, paths []string) ErrorList {
 	if err == nil {
 		p.file = &parseFile{
 			stream: *NewLexStream(&filename, bytes),
+			name:   &filename,
 			paths:  append(paths, filepath.Dir(fullname)),
 			prev:   p.file,
 		}
@@ -268,26 +313,155 @@ func (it item) String() string {
 	return ret
 }
 
+// rebaseInts returns s with all integer constants converted to the given
+// base, leaving string literals untouched.
+func rebaseInts(pos ItemPos, s string, base uint8) string {
+	ret := ""
+	for stream := NewLexStreamAt(pos, s); stream.peek() != eof; {
+		start := stream.c
+		stream.ignore(whitespace)
+		ret += s[start:stream.c]
+
+		token := stream.nextToken(shuntDelim)
+		if len(token) == 1 && quotes.matches(token[0]) {
+			token += stream.nextString(charGroup{token[0]})
+			if stream.peek() != eof {
+				token += string(stream.next())
+			}
+		} else if isAsmReal(token + "0") {
+			// Signed exponents.
+			last := token[len(token)-1]
+			if sign := stream.peek(); (last == 'e' || last == 'E') &&
+				(sign == '+' || sign == '-') {
+				token += string(stream.next()) + stream.nextString(shuntDelim)
+			}
+		} else if isAsmInt(token) {
+			if n, err := newAsmInt(token); err == nil {
+				n.base = base
+				token = n.String()
+			}
+		}
+		ret += token
+	}
+	return ret
+}
+
+// Rebase returns a copy of it with all integer constants in its parameters
+// converted to the given base.
+func (it item) Rebase(base uint8) item {
+	params := make(itemParams, len(it.params))
+	for i, param := range it.params {
+		params[i] = rebaseInts(it.pos, param, base)
+	}
+	it.params = params
+	return it
+}
+
 func main() {
 	filename := kingpin.Arg(
 		"filename", "Assembly file.",
 	).Required().ExistingFile()
 
 	syntax := kingpin.Flag(
-		"syntax", "Target assembler.",
-	).Default("TASM").Enum("TASM", "MASM")
+		"syntax", "Target assembler, or AUTO to guess it from the directives used in the main file.",
+	).Default("AUTO").Enum("AUTO", "TASM", "MASM")
 
 	includes := kingpin.Flag(
 		"include", "Add the given directory to the list of assembly include directories.",
 	).Default(".").Short('I').Strings()
 
+	deferUnresolved := kingpin.Flag(
+		"defer-unresolved", "Report every unknown symbol only once after parsing, together with all of its use sites.",
+	).Bool()
+
+	wordSize := kingpin.Flag(
+		"word-size", "Default word size in bytes for code without CPU directives.",
+	).Default("2").Enum("2", "4", "8")
+
+	maxWhile := kingpin.Flag(
+		"max-while-iterations", "Abort WHILE loops after this many iterations.",
+	).Default("100000").Int()
+
+	maxInclude := kingpin.Flag(
+		"max-include-depth", "Abort parsing if INCLUDE directives are nested deeper than this.",
+	).Default("50").Int()
+
+	maxMacro := kingpin.Flag(
+		"max-macro-depth", "Abort macro expansions that are nested deeper than this.",
+	).Default("256").Int()
+
+	maxErrors := kingpin.Flag(
+		"max-errors", "Abort parsing after this many errors, or 0 for no limit.",
+	).Default("0").Int()
+
+	verbosity := kingpin.Flag(
+		"verbosity", "Only print messages of at least this severity.",
+	).Default("warning").Enum("debug", "warning", "error")
+
+	base := kingpin.Flag(
+		"base", "Convert all integer constants in the reconstructed assembly to this base.",
+	).Default("keep").Enum("keep", "binary", "octal", "decimal", "hex")
+
+	emit := kingpin.Flag(
+		"emit", "Output format: reconstructed assembly (asm), reconstructed assembly with all macros, repeat blocks, conditionals, and includes resolved (expanded), a C header with all constants (h), C declarations of all structures, variables, and procedures (c), the parsed instructions as JSON (json), a tree of the memory layout (layout), the linker names of all public and external symbols (map), or all addresses stored in data (relocs).",
+	).Default("asm").Enum("asm", "expanded", "h", "c", "json", "layout", "map", "relocs")
+
+	output := kingpin.Flag(
+		"output", "Write the output to the given file instead of stdout.",
+	).Short('o').String()
+
 	kingpin.Parse()
+	bases := map[string]uint8{"binary": 2, "octal": 8, "decimal": 10, "hex": 16}
+
+	switch *verbosity {
+	case "debug":
+		logSeverity = ESDebug
+	case "error":
+		logSeverity = ESError
+	}
 
-	p, err := Parse(*filename, *syntax, *includes)
+	p, err := Parse(*filename, ParseOptions{
+		Syntax:             *syntax,
+		IncludePaths:       *includes,
+		DeferUnresolved:    *deferUnresolved,
+		WordSize:           (*wordSize)[0] - '0',
+		MaxWhileIterations: *maxWhile,
+		MaxIncludeDepth:    *maxInclude,
+		MaxMacroDepth:      *maxMacro,
+		MaxErrors:          *maxErrors,
+	})
 	err.Print()
 
-	for _, i := range p.instructions {
-		fmt.Println(i)
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, errCreate := os.Create(*output)
+		if errCreate != nil {
+			NewErrorList(ESFatal, errCreate).Print()
+		}
+		defer file.Close()
+		w = file
+	}
+
+	switch *emit {
+	case "h":
+		EmitCDefines(w, &p.syms)
+	case "c":
+		EmitC(w, &p.syms)
+		EmitCFunctions(w, &p.syms, p.procs)
+	case "json":
+		if errJSON := EmitJSON(w, p.instructions); errJSON != nil {
+			NewErrorList(ESFatal, errJSON).Print()
+		}
+	case "layout":
+		EmitLayout(w, &p.syms)
+	case "map":
+		EmitMap(w, &p.syms)
+	case "relocs":
+		EmitRelocs(w, &p.syms)
+	case "expanded":
+		EmitAsm(w, Expanded(p.instructions), bases[*base])
+	default:
+		EmitAsm(w, p.instructions, bases[*base])
 	}
 	ErrorListFAt(NewItemPos(filename, 0), ESDebug,
 		"Symbols: [\n%s\n]", p.syms,
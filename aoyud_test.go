@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// parseString parses src as the main file of a temporary directory, which
+// is also used as the include path.
+func parseString(t *testing.T, src string, opts ParseOptions) (*parser, ErrorList) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "test.asm"), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts.IncludePaths = append(opts.IncludePaths, dir)
+	if opts.Syntax == "" {
+		opts.Syntax = "MASM"
+	}
+	return Parse("test.asm", opts)
+}
+
+// checkGolden parses testdata/name.asm and compares the output that emit
+// writes for it with testdata/name.golden.
+func checkGolden(t *testing.T, name string, emit func(w io.Writer, p *parser)) {
+	t.Helper()
+	p, err := Parse(name+".asm", ParseOptions{
+		Syntax: "MASM", IncludePaths: []string{"testdata"},
+	})
+	checkErrors(t, err, ESWarning, "")
+	var buf bytes.Buffer
+	emit(&buf, p)
+	golden := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, errRead := os.ReadFile(golden)
+	if errRead != nil {
+		t.Fatal(errRead)
+	}
+	if got := buf.String(); got != string(want) {
+		t.Errorf("output differs from %s:\n%s", golden, got)
+	}
+}
+
+// findError returns the first error in err at or above the given severity
+// that contains substr.
+func findError(err ErrorList, sev ErrorSeverity, substr string) *Error {
+	for i := range err {
+		if err[i].sev >= sev && strings.Contains(err[i].s, substr) {
+			return &err[i]
+		}
+	}
+	return nil
+}
+
+// checkErrors reports a test failure if err doesn't contain an error at or
+// above the given severity that contains substr, or if it contains one
+// although substr is empty.
+func checkErrors(t *testing.T, err ErrorList, sev ErrorSeverity, substr string) {
+	t.Helper()
+	if substr == "" {
+		if err.Severity() >= sev {
+			t.Errorf("unexpected errors:\n%s", errorsString(err))
+		}
+	} else if findError(err, sev, substr) == nil {
+		t.Errorf("expected %q, got:\n%s", substr, errorsString(err))
+	}
+}
+
+// checkOutput reports a test failure if the lines in want don't appear in
+// the given output, in the same order.
+func checkOutput(t *testing.T, out string, want []string) {
+	t.Helper()
+	rest := out
+	for _, line := range want {
+		i := strings.Index(rest, line)
+		if i == -1 {
+			t.Errorf("missing %q in:\n%s", line, out)
+			return
+		}
+		rest = rest[i+len(line):]
+	}
+}
+
+func errorsString(err ErrorList) string {
+	var lines []string
+	for _, e := range err {
+		lines = append(lines, e.pos.String()+e.sev.String()+e.s)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// symInt returns the value of the integer symbol with the given name.
+func symInt(t *testing.T, p *parser, name string) int64 {
+	t.Helper()
+	val, err := p.syms.Get(name)
+	if n, ok := val.(asmInt); ok && err.Severity() < ESError {
+		return n.n
+	}
+	t.Errorf("%s is not an integer: %v %s", name, val, errorsString(err))
+	return 0
+}
+
+// segmentBytes returns the emitted bytes of the first chunk of the segment
+// with the given name.
+func segmentBytes(t *testing.T, p *parser, name string) []byte {
+	t.Helper()
+	val, _ := p.syms.Get(name)
+	seg, ok := val.(*asmSegment)
+	if !ok {
+		t.Fatalf("%s is not a segment: %v", name, val)
+	}
+	if len(seg.chunks) == 0 {
+		return nil
+	}
+	return seg.chunks[0].Emit()
+}
+
+func TestIncludeDepth(t *testing.T) {
+	// Every level includes the main file again, until n reaches the count.
+	tests := []struct {
+		count int
+		err   string
+	}{
+		{4, ""},
+		{5, "include depth exceeds 3, aborting: test.asm"},
+		{1000, "include depth exceeds 3, aborting: test.asm"},
+	}
+	for _, test := range tests {
+		src := fmt.Sprintf("ifndef n\nn = 0\nendif\nn = n + 1\nif n lt %d\ninclude test.asm\nendif\n", test.count)
+		_, err := parseString(t, src, ParseOptions{MaxIncludeDepth: 3})
+		checkErrors(t, err, ESWarning, test.err)
+		if e := findError(err, ESFatal, "include depth"); test.err != "" && e == nil {
+			t.Errorf("%d levels: no fatal error:\n%s", test.count, errorsString(err))
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package main
 
+import "strings"
+
 type KeywordType int
 
 const (
@@ -22,8 +24,12 @@ const (
 	Mandatory
 )
 
+// KeywordFunc evaluates a directive. All handlers return their errors by
+// value, and callers check them using ErrorList.Severity().
+type KeywordFunc func(p *parser, it *item) ErrorList
+
 type Keyword struct {
-	Func       func(p *parser, it *item) ErrorList
+	Func       KeywordFunc
 	Sym        SymRule
 	Type       KeywordType
 	ParamRange Range
@@ -43,15 +49,25 @@ func init() {
 
 	Keywords = map[string]Keyword{
 		"INCLUDE": {INCLUDE, NotAllowed, Evaluated | SingleParam, req(1)},
+		"%OUT":    {OUT, NotAllowed, Evaluated | SingleParam, Range{0, 1}},
+		"ECHO":    {OUT, NotAllowed, Evaluated | SingleParam, Range{0, 1}},
+		"PAGE":    {PAGE, NotAllowed, SingleParam, Range{0, 1}},
+		"IDEAL":   {IDEAL, NotAllowed, 0, req(0)},
 		"PROC":    {PROC, Mandatory, Code, Range{0, -1}},
 		"ENDP":    {ENDP, Optional, Code, req(0)},
+		"ARG":     {ARG, NotAllowed, NoStruct, Range{1, -1}},
+		"LOCAL":   {LOCAL, NotAllowed, NoStruct, Range{1, -1}},
+		"USES":    {USES, NotAllowed, NoStruct, Range{1, -1}},
 		".MODEL":  {MODEL, NotAllowed, NoStruct, Range{1, 4}},
 		// Equates
 		"=":       {EQUALS, Mandatory, 0, req(1)},
 		"EQU":     {EQU, Mandatory, 0, Range{1, -1}},
 		"TEXTEQU": {nil, Mandatory, 0, req(1)}, // TODO
-		"TYPEDEF": {nil, Mandatory, 0, req(1)}, // TODO
+		"TYPEDEF": {TYPEDEF, Mandatory, 0, req(1)},
 		"LABEL":   {LABEL, Mandatory, Data, req(1)},
+		"ORG":     {ORG, NotAllowed, Code, req(1)},
+		"ALIGN":   {ALIGN, NotAllowed, Data, req(1)},
+		"EVEN":    {ALIGN, NotAllowed, Data, req(0)},
 		// Conditionals
 		"IFDEF":      {IFDEF, NotAllowed, Conditional, req(1)},
 		"IFNDEF":     {IFDEF, NotAllowed, Conditional, req(1)},
@@ -63,6 +79,8 @@ func init() {
 		"IFIDNI":     {IFIDN, NotAllowed, Conditional, req(2)},
 		"IFDIF":      {IFIDN, NotAllowed, Conditional, req(2)},
 		"IFDIFI":     {IFIDN, NotAllowed, Conditional, req(2)},
+		"IF1":        {IFPASS, NotAllowed, Conditional, req(0)},
+		"IF2":        {IFPASS, NotAllowed, Conditional, req(0)},
 		"ELSEIFDEF":  {ELSEIFDEF, NotAllowed, Conditional, req(1)},
 		"ELSEIFNDEF": {ELSEIFDEF, NotAllowed, Conditional, req(1)},
 		"ELSEIF":     {ELSEIF, NotAllowed, Conditional, req(1)},
@@ -73,6 +91,8 @@ func init() {
 		"ELSEIFIDNI": {ELSEIFIDN, NotAllowed, Conditional, req(2)},
 		"ELSEIFDIF":  {ELSEIFIDN, NotAllowed, Conditional, req(2)},
 		"ELSEIFDIFI": {ELSEIFIDN, NotAllowed, Conditional, req(2)},
+		"ELSEIF1":    {ELSEIFPASS, NotAllowed, Conditional, req(0)},
+		"ELSEIF2":    {ELSEIFPASS, NotAllowed, Conditional, req(0)},
 		"ELSE":       {ELSE, NotAllowed, Conditional, req(0)},
 		"ENDIF":      {ENDIF, NotAllowed, Conditional, req(0)},
 		"OPTION":     {OPTION, NotAllowed, 0, Range{1, -1}},
@@ -85,7 +105,8 @@ func init() {
 		"WHILE":  {DummyMacro, NotAllowed, Macro, req(1)},
 		"IRP":    {DummyMacro, NotAllowed, Macro, req(2)},
 		"IRPC":   {DummyMacro, NotAllowed, Macro, req(2)},
-		"ENDM":   {ENDM, NotAllowed, Macro, req(0)},
+		"ENDM":   {ENDM, Optional, Macro, req(0)},
+		"EXITM":  {EXITM, NotAllowed, Evaluated, Range{0, 1}},
 		// CPUs
 		".8086": cpu, "P8086": cpu,
 		".186": cpu, "P186": cpu,
@@ -117,6 +138,11 @@ func init() {
 		"SEGMENT": {SEGMENT, Mandatory, NoStruct, Range{0, 1}},
 		"ENDS":    {ENDS, Optional, 0, req(0)},
 		"GROUP":   {GROUP, Mandatory, 0, Range{1, -1}},
+		"ASSUME":  {ASSUME, NotAllowed, 0, Range{1, -1}},
+		// Linkage
+		"PUBLIC": {PUBLIC, NotAllowed, 0, Range{1, -1}},
+		"EXTRN":  {EXTRN, NotAllowed, 0, Range{1, -1}},
+		"EXTERN": {EXTRN, NotAllowed, 0, Range{1, -1}},
 
 		".CODE": simseg, "CODESEG": simseg,
 		".DATA": simseg, "DATASEG": simseg,
@@ -134,15 +160,20 @@ func init() {
 		"DF": data,
 		"DP": data,
 		"DT": data,
+		// Real number allocations
+		"REAL4":  data,
+		"REAL8":  data,
+		"REAL10": data,
 		// Structures
 		"STRUCT": {STRUC, Optional, 0, Range{0, 2}}, // Yes, it's possible to have
 		"STRUC":  {STRUC, Optional, 0, Range{0, 2}}, // unnamed structures and
 		"UNION":  {STRUC, Optional, 0, Range{0, 2}}, // unions inside named ones.
-		// String functions (all TODO)
-		"CATSTR":  {nil, Mandatory, 0, Range{1, -1}},
-		"SIZESTR": {nil, Mandatory, 0, req(1)},
-		"INSTR":   {nil, Mandatory, 0, Range{2, 3}},
-		"SUBSTR":  {nil, Mandatory, 0, Range{2, 3}},
+		"RECORD": {RECORD, Mandatory, 0, Range{1, -1}},
+		// String functions
+		"CATSTR":  {nil, Mandatory, 0, Range{1, -1}}, // TODO
+		"SIZESTR": {nil, Mandatory, 0, req(1)},       // TODO
+		"INSTR":   {INSTR, Mandatory, 0, Range{2, 3}},
+		"SUBSTR":  {SUBSTR, Mandatory, 0, Range{2, 3}},
 		// High-level language directives (all TODO)
 		".IF":       hll,
 		".ELSE":     hll,
@@ -157,3 +188,27 @@ func init() {
 		".ENDW":     hll,
 	}
 }
+
+// registers lists the names of all x86 registers.
+var registers = map[string]bool{
+	"AL": true, "AH": true, "BL": true, "BH": true,
+	"CL": true, "CH": true, "DL": true, "DH": true,
+	"AX": true, "BX": true, "CX": true, "DX": true,
+	"SI": true, "DI": true, "BP": true, "SP": true,
+	"EAX": true, "EBX": true, "ECX": true, "EDX": true,
+	"ESI": true, "EDI": true, "EBP": true, "ESP": true,
+	"RAX": true, "RBX": true, "RCX": true, "RDX": true,
+	"RSI": true, "RDI": true, "RBP": true, "RSP": true,
+	"CS": true, "DS": true, "ES": true, "SS": true, "FS": true, "GS": true,
+	"ST": true, "CR0": true, "CR2": true, "CR3": true, "CR4": true,
+	"DR0": true, "DR1": true, "DR2": true, "DR3": true, "DR6": true, "DR7": true,
+}
+
+// isReserved returns whether name is a register, directive, or type name,
+// which MASM considers to be always defined.
+func isReserved(name string) bool {
+	name = strings.ToUpper(name)
+	_, directive := Keywords[name]
+	_, typ := asmTypes[name]
+	return registers[name] || directive || typ
+}
@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+// All directive handlers share the KeywordFunc signature, which the compiler
+// verifies through this list.
+var _ = []KeywordFunc{
+	ALIGN, ARG, ASSUME, CPU, DATA, DummyMacro, ELSE, ELSEIF, ELSEIFB,
+	ELSEIFDEF, ELSEIFIDN, ELSEIFPASS, ENDIF, ENDM, ENDP, ENDS, EQU, EQUALS,
+	EXITM, EXTRN, GROUP, IDEAL, IF, IFB, IFDEF, IFIDN, IFPASS, INCLUDE, INSTR,
+	LABEL, LOCAL, MACRO, MODEL, OPTION, ORG, OUT, PAGE, PROC, PUBLIC, RECORD,
+	SEGMENT, SIMSEG, STACK, STRUC, SUBSTR, TYPEDEF, USES,
+}
+
+func TestKeywordErrors(t *testing.T) {
+	// Handlers return their errors by value, which eval passes on as is.
+	_, err := parseString(t, "d segment\norg -1\nd ends\n", ParseOptions{})
+	checkErrors(t, err, ESError, "ORG offset can't be negative")
+	_, err = parseString(t, "align 3\n", ParseOptions{})
+	checkErrors(t, err, ESError, "requires a segment")
+}
@@ -35,7 +35,10 @@ type asmInt struct {
 	n        int64  // The value itself
 	ptr      uint64 // Nonzero values turn the integer into a pointer of this length
 	base     uint8
-	wordsize uint8 // Number of bytes to be produced on Emit()
+	wordsize uint8     // Number of bytes to be produced on Emit()
+	reloc    *asmReloc // Address that is fixed up by the linker, if any
+	addr     bool      // Derived from an address that is only final in pass 2?
+	uninit   bool      // Reserved using ?, without an initial value?
 }
 
 func (v asmInt) Thing() string {
@@ -61,6 +64,9 @@ func (v asmInt) String() string {
 	var ret string
 	if v.base == 0 {
 		v.base = 10
+	} else if v.base == 255 && !v.isASCII() {
+		// Arithmetic on character literals can result in anything.
+		v.base = 16
 	}
 	if v.base <= 16 {
 		ret = strconv.FormatInt(v.n, int(v.base))
@@ -127,6 +133,27 @@ func isAsmInt(input string) bool {
 func newAsmInt(input string) (asmInt, ErrorList) {
 	length := len(input)
 	base := uint8(0)
+	if length > 2 && input[0] == '0' {
+		// C-style prefixes. 0B might also be the start of a hex number,
+		// so we only take it as binary if the rest couldn't be anything
+		// else.
+		rest := input[2:]
+		switch input[1] {
+		case 'x', 'X':
+			base = 16
+		case 'b', 'B':
+			if strings.Trim(rest, "01") == "" {
+				base = 2
+			}
+		}
+		if base != 0 {
+			n, err := strconv.ParseInt(rest, int(base), 0)
+			if err != nil {
+				return asmInt{}, NewErrorList(ESError, err)
+			}
+			return asmInt{n: n, base: base}, nil
+		}
+	}
 	switch unicode.ToLower(rune(input[length-1])) {
 	case 'b':
 		base = 2
@@ -160,6 +187,31 @@ func (v asmExpression) String() string {
 	return "(" + string(v) + ")"
 }
 
+// Text returns the contents of v without a pair of enclosing angle brackets,
+// as used when expanding v as a text macro.
+func (v asmExpression) Text() string {
+	if l := len(v); l >= 2 && v[0] == '<' && v[l-1] == '>' {
+		return string(v[1 : l-1])
+	}
+	return string(v)
+}
+
+// asmText represents a text macro that isn't an arithmetic expression.
+type asmText string
+
+func (v asmText) Thing() string {
+	return "text macro"
+}
+
+func (v asmText) String() string {
+	return "<" + v.Text() + ">"
+}
+
+// Text returns the contents of v without a pair of enclosing angle brackets.
+func (v asmText) Text() string {
+	return asmExpression(v).Text()
+}
+
 type asmMacroArg struct {
 	name string
 	typ  string
@@ -227,7 +279,9 @@ func (p *parser) newMacro(itemNum int) (ret asmMacro, err ErrorList) {
 			}
 		} else if !(args[i].typ == "" || args[i].typ == "REQ") {
 			if typOrg[0] == '=' {
-				def, err := p.text(strings.TrimSpace(typOrg[1:]))
+				// Defaults work just like passed arguments, so they
+				// don't need to be enclosed in angle brackets.
+				def, err := p.macroArg(strings.TrimSpace(typOrg[1:]))
 				if err.Severity() >= ESError {
 					return asmMacro{}, err
 				}
@@ -264,58 +318,144 @@ func (p *parser) newMacro(itemNum int) (ret asmMacro, err ErrorList) {
 	return asmMacro{args, code, locals}, err
 }
 
-// expandMacro expands the multiline macro m using the parameters of it and
-// calls p.evalNew for every line in the macro. Returns false if the expansion
-// was successful, true otherwise.
-func (p *parser) expandMacro(m asmMacro, it *item) (bool, ErrorList) {
-	var errList ErrorList
-	replaceMap := make(map[string]string)
-
-	setArg := func(name string, i int) (bool, ErrorList) {
-		var text string
-		var err ErrorList
-		ret := len(it.params) > i && len(it.params[i]) > 0
-		if ret {
-			if it.params[i][0] == '<' || it.params[i][0] == '%' {
-				text, err = p.text(it.params[i])
-				if err.Severity() >= ESError {
-					return false, err
-				}
-				replaceMap[name] = text
-			} else {
-				replaceMap[name] = it.params[i]
+// macroArg returns the value of a single argument passed to a macro or
+// repeat block, resolving <text strings> and %text_macros.
+func (p *parser) macroArg(param string) (string, ErrorList) {
+	if len(param) > 0 && (param[0] == '<' || param[0] == '%') {
+		return p.text(param)
+	}
+	return param, nil
+}
+
+// blankArg is substituted for blank macro arguments in the arithmetic
+// condition of an IF or ELSEIF directive, which is then evaluated as per IFB
+// rather than as an incomplete expression.
+const blankArg = "<>"
+
+// blankConditions lists the directives that receive blankArg.
+var blankConditions = map[string]bool{
+	"IF":      true,
+	"IFE":     true,
+	"ELSEIF":  true,
+	"ELSEIFE": true,
+}
+
+// hasBlankArg returns whether the condition s contains a substituted blank
+// macro argument.
+func hasBlankArg(pos ItemPos, s string) bool {
+	stream := NewLexStreamAt(pos, s)
+	for stream.peek() != eof {
+		switch token := stream.nextToken(shuntDelim); token {
+		case "'", "\"":
+			stream.nextString(charGroup{token[0]})
+			stream.next()
+		case "<":
+			if stream.peek() == '>' {
+				return true
 			}
 		}
-		return ret, err
 	}
+	return false
+}
 
-	replace := func(it *item, s string) string {
-		ret := ""
-		andCached := false
+// macroToken is a single token in a line of macro code, together with the
+// whitespace in front of it.
+type macroToken struct {
+	space string
+	token string
+	param bool // Substituted parameter value?
+}
+
+// macroReplacer returns a function that substitutes all parameter names in a
+// line of macro code with their values in replaceMap. A single & on each side
+// of a parameter name is removed, which concatenates its value with the
+// surrounding text. All other & characters are kept, for nested macros and
+// repeat blocks.
+func (p *parser) macroReplacer(replaceMap map[string]string) func(it *item, s string) string {
+	return func(it *item, s string) string {
+		isCond := blankConditions[strings.ToUpper(it.val)]
+		var tokens []macroToken
 		for stream := NewLexStreamAt(it.pos, s); stream.peek() != eof; {
 			// Be sure to copy any whitespace in s.
 			start := stream.c
 			stream.ignore(whitespace)
-			ret += s[start:stream.c]
-
-			token := stream.nextToken(macroDelim)
-			if token == "&" {
-				andCached = true
-				token = ""
-			} else if arg, ok := replaceMap[p.syms.ToSymCase(token)]; ok {
-				token = arg
-				if stream.peek() == '&' {
-					stream.next()
+			t := macroToken{space: s[start:stream.c]}
+
+			// TASM also substitutes parameters that are directly adjacent to
+			// punctuation, like in "arg.member", while MASM requires &.
+			if p.syntax == "TASM" {
+				t.token = stream.nextSymbolToken(macroDelim)
+			} else {
+				t.token = stream.nextToken(macroDelim)
+			}
+			if arg, ok := replaceMap[p.syms.ToSymCase(t.token)]; ok {
+				if isCond && strings.TrimSpace(arg) == "" {
+					arg = blankArg
+				}
+				t.token = arg
+				t.param = true
+			}
+			tokens = append(tokens, t)
+		}
+		ret := ""
+		for i, t := range tokens {
+			ret += t.space
+			if t.token == "&" {
+				prevParam := i > 0 && tokens[i-1].param && t.space == ""
+				nextParam := i+1 < len(tokens) && tokens[i+1].param &&
+					tokens[i+1].space == ""
+				if prevParam {
+					// Only consume one & on the right side.
+					tokens[i-1].param = false
+					continue
+				} else if nextParam {
+					continue
 				}
-				andCached = false
-			} else if andCached {
-				ret += "&"
-				andCached = false
 			}
-			ret += token
+			ret += t.token
 		}
 		return ret
 	}
+}
+
+// expandMacro expands the multiline macro m using the parameters of it and
+// calls p.evalNew for every line in the macro. Returns false if the expansion
+// was successful, true otherwise.
+func (p *parser) expandMacro(m asmMacro, it *item) (bool, ErrorList) {
+	var errList ErrorList
+	replaceMap := make(map[string]string)
+
+	limit := p.opts.MaxMacroDepth
+	if limit <= 0 {
+		limit = defaultMaxMacroDepth
+	}
+	// Dropping the invocation keeps pass 2 from expanding it again. Since
+	// pass 1 errors are dropped as well, the error has to be kept in
+	// p.evalErrs, at the outermost invocation rather than the whole chain.
+	if p.macroDepth >= limit {
+		pos := it.pos
+		if len(pos) > 2 {
+			pos = ItemPos{pos[0], pos[len(pos)-1]}
+		}
+		err := ErrorListFAt(pos, ESError,
+			"macro expansion depth exceeds %d, aborting: %s", limit, it.val,
+		)
+		p.evalErrs = p.evalErrs.AddL(err)
+		return false, err
+	}
+
+	setArg := func(name string, i int) (bool, ErrorList) {
+		ret := len(it.params) > i && len(it.params[i]) > 0
+		if ret {
+			text, err := p.macroArg(it.params[i])
+			if err.Severity() >= ESError {
+				return false, err
+			}
+			replaceMap[name] = text
+			return ret, err
+		}
+		return ret, nil
+	}
 
 	for i, arg := range m.args {
 		var got bool
@@ -335,6 +475,10 @@ func (p *parser) expandMacro(m asmMacro, it *item) (bool, ErrorList) {
 	}
 	if errList.Severity() >= ESError {
 		return true, errList
+	} else if p.pass2 {
+		// The expanded lines have already been added to the instruction
+		// list in pass 1.
+		return true, errList
 	}
 	for _, local := range m.locals {
 		// Who knows, some code might actually rely on the resulting
@@ -342,18 +486,55 @@ func (p *parser) expandMacro(m asmMacro, it *item) (bool, ErrorList) {
 		replaceMap[local] = fmt.Sprintf("??%04X", p.macroLocalCount)
 		p.macroLocalCount++
 	}
-	for i := range m.code {
-		line := replace(&m.code[i], m.code[i].String())
-		stream := NewLexStreamAt(it.pos, line)
-		stream.pos = append(stream.pos, m.code[i].pos...)
-		expanded, err := p.lexItem(stream)
-		errList = errList.AddL(err)
-		if err.Severity() < ESError {
+	replace := p.macroReplacer(replaceMap)
+	p.macroDepth++
+	errExpand := p.expand(func() ErrorList {
+		return p.expandLines(it.pos, m.code, replace)
+	})
+	p.macroDepth--
+	return false, errList.AddL(errExpand)
+}
+
+// expand runs the given expansion of a macro or repeat block, which ends
+// early once it evaluates an EXITM directive.
+func (p *parser) expand(expansion func() ErrorList) ErrorList {
+	p.expanding++
+	err := expansion()
+	p.expanding--
+	p.exitm = false
+	return err
+}
+
+func EXITM(p *parser, it *item) ErrorList {
+	if p.expanding == 0 {
+		return ErrorListF(ESError, "EXITM outside of a macro or repeat block")
+	}
+	p.exitm = true
+	return nil
+}
+
+// expandLines re-lexes every line in code, optionally transformed by replace,
+// at the given position prefix and calls p.evalNew for the resulting items.
+func (p *parser) expandLines(pos ItemPos, code []item, replace func(it *item, s string) string) (err ErrorList) {
+	for i := range code {
+		line := code[i].String()
+		if replace != nil {
+			line = replace(&code[i], line)
+		}
+		stream := NewLexStreamAt(pos, line)
+		stream.pos = append(stream.pos, code[i].pos...)
+		expanded, errLex := p.lexItem(stream)
+		err = err.AddL(errLex)
+		if errLex.Severity() < ESError && expanded != nil {
 			expanded.num = len(p.instructions)
-			errList = errList.AddLAt(expanded.pos, p.evalNew(expanded))
+			expanded.generated = true
+			err = err.AddLAt(expanded.pos, p.evalNew(expanded))
+		}
+		if p.exitm {
+			break
 		}
 	}
-	return false, errList
+	return err
 }
 
 // NestInfo represents a type of named block that can be nested.
@@ -393,23 +574,41 @@ type parser struct {
 	instructions []item
 	// General state
 	pass2           bool
+	opts            ParseOptions
 	file            *parseFile
 	syntax          string
+	ideal           bool // TASM's Ideal mode active?
 	syms            SymMap
 	intSyms         InternalSyms
 	caseSensitive   bool
-	macroLocalCount int    // Number of LOCAL directives expanded
-	segCodeName     string // Name of the segment entered with .CODE
-	segDataName     string // Name of the segment entered with .DATA
+	macroLocalCount int // Number of LOCAL directives expanded
+	// Expansion of the last closed repeat block, to be evaluated right after
+	// its ENDM has been added to the instruction list.
+	expansion   func() ErrorList
+	loopErrs    map[int]ErrorList // Aborted WHILE loops by header item number
+	expanding   int               // Nesting level of macro and block expansions
+	macroDepth  int               // Nesting level of macro expansions only
+	exitm       bool              // EXITM reached in the current expansion?
+	evalErrs    ErrorList         // Errors of Evaluated directives, from pass 1
+	page        listingPage       // Pagination state set by PAGE
+	segCodeName string            // Name of the segment entered with .CODE
+	segDataName string            // Name of the segment entered with .DATA
+	// Segment register → *asmSegment or *asmGroup, as set by ASSUME.
+	assumes map[string]asmVal
 	// Open blocks
-	proc   NestInfo
-	macro  NestInfo
-	strucs []Nestable
-	segs   []Nestable
+	proc     NestInfo
+	procSeg  EmissionTarget // Segment containing the opening PROC directive
+	procDecl asmProc        // Declarations of the currently open procedure
+	procs    []asmProc      // All procedures closed in pass 2
+	macro    NestInfo
+	strucs   []Nestable
+	segs     []Nestable
 	// Conditionals
 	ifNest  int  // IF nesting level
 	ifMatch int  // Last IF nesting level that evaluated to true
 	ifElse  bool // Can the current level still have an ELSE* block?
+	// Conditional blocks opened by IF1 or IF2 in pass 1
+	passBlocks []passBlock
 }
 
 func splitColon(s string) (string, string) {
@@ -431,7 +630,7 @@ func (it *item) missingRequiredSym() ErrorList {
 
 func (it *item) checkSyntaxFor(k Keyword) ErrorList {
 	if k.Sym == Mandatory {
-		if err := it.missingRequiredSym(); err != nil {
+		if err := it.missingRequiredSym(); err.Severity() >= ESError {
 			return err
 		}
 	}
@@ -439,9 +638,15 @@ func (it *item) checkSyntaxFor(k Keyword) ErrorList {
 }
 
 func PROC(p *parser, it *item) (err ErrorList) {
+	if !isSymbol(it.sym) {
+		return ErrorListF(ESError, "invalid procedure name: %s", it.sym)
+	}
 	if p.proc.nest == 0 {
 		p.proc.name = it.sym
 		p.proc.start = it.num
+		p.procSeg = p.CurrentEmissionTarget()
+		p.procDecl = asmProc{name: it.sym}
+		err = err.AddL(p.procDeclaration(it))
 	} else {
 		err = ErrorListF(ESWarning, "ignoring nested procedure %s", it.sym)
 	}
@@ -455,10 +660,37 @@ func ENDP(p *parser, it *item) (err ErrorList) {
 			"ignoring procedure without a PROC directive: %s", it.sym,
 		)
 	} else if p.proc.nest == 1 {
-		err = ErrorListF(ESDebug,
+		// Labels in front of ENDP are separate items, so it.sym can only
+		// be the procedure name.
+		if it.sym != "" && !p.syms.Equal(it.sym, p.proc.name) {
+			err = err.AddF(ESError,
+				"ENDP name doesn't match open procedure %s: %s",
+				p.proc.name, it.sym,
+			)
+		}
+		err = err.AddF(ESDebug,
 			"found procedure %s ranging from lex items #%d-#%d",
 			p.proc.name, p.proc.start, it.num,
 		)
+		if seg := p.CurrentEmissionTarget(); seg != p.procSeg {
+			err = err.AddF(ESWarning,
+				"procedure %s opened in segment %s, but closed in %s",
+				p.proc.name, p.procSeg.Name(), seg.Name(),
+			)
+		}
+		// Only pass 2 sees the complete instruction list.
+		if p.pass2 {
+			for _, ins := range p.instructions[p.proc.start+1 : it.num] {
+				switch ins.val {
+				case "ARG", "LOCAL", "USES":
+				default:
+					if ins.typ == itemInstruction {
+						p.procDecl.instructions++
+					}
+				}
+			}
+			p.procs = append(p.procs, p.procDecl)
+		}
 	}
 	p.proc.nest--
 	return err
@@ -480,7 +712,7 @@ func MODEL(p *parser, it *item) (err ErrorList) {
 	farstack := false
 	showNearstackWarning := false
 	thirtytwo := uint8(0)
-	language := uint8(0)
+	language := LangNone
 	codesegname := ""
 	datasegname := ""
 
@@ -519,16 +751,16 @@ func MODEL(p *parser, it *item) (err ErrorList) {
 
 	// interfaces defines values for the @Interface symbol.
 	interfaces := modifiers{typ: "language", m: modifierMap{
-		"NOLANGUAGE": func() ErrorList { language = 0; return nil },
-		"C":          func() ErrorList { language = 1; return nil },
-		"SYSCALL":    func() ErrorList { language = 2; return nil },
-		"STDCALL":    func() ErrorList { language = 3; return nil },
-		"PASCAL":     func() ErrorList { language = 4; return nil },
-		"FORTRAN":    func() ErrorList { language = 5; return nil },
-		"BASIC":      func() ErrorList { language = 6; return nil },
-		"FASTCALL":   func() ErrorList { language = 7; return nil }, // MASM only
-		"PROLOG":     func() ErrorList { language = 7; return nil },
-		"CPP":        func() ErrorList { language = 8; return nil },
+		"NOLANGUAGE": func() ErrorList { language = LangNone; return nil },
+		"C":          func() ErrorList { language = LangC; return nil },
+		"SYSCALL":    func() ErrorList { language = LangSyscall; return nil },
+		"STDCALL":    func() ErrorList { language = LangStdcall; return nil },
+		"PASCAL":     func() ErrorList { language = LangPascal; return nil },
+		"FORTRAN":    func() ErrorList { language = LangFortran; return nil },
+		"BASIC":      func() ErrorList { language = LangBasic; return nil },
+		"FASTCALL":   func() ErrorList { language = LangProlog; return nil }, // MASM only
+		"PROLOG":     func() ErrorList { language = LangProlog; return nil },
+		"CPP":        func() ErrorList { language = LangCPP; return nil },
 	}}
 	languageModifiers := modifiers{typ: "language modifier", m: modifierMap{
 		"NORMAL":  func() ErrorList { return nil },
@@ -607,6 +839,9 @@ func MODEL(p *parser, it *item) (err ErrorList) {
 				} else if p.syntax == "MASM" {
 					p.intSyms.SymModel = &masmFlat.model
 				}
+				// Flat code uses 32-bit segments by default, regardless of
+				// the syntax.
+				thirtytwo = 1
 			}
 			if mod.model&Flat != 0 {
 				err = err.AddL(parseStack(true))
@@ -726,6 +961,12 @@ func MODEL(p *parser, it *item) (err ErrorList) {
 	}
 	p.intSyms.StackGroup = &stackgroup
 
+	// All segment registers refer to the whole address space in the flat
+	// model, which is the same as assuming nothing.
+	if model == Flat {
+		p.assumes = make(map[string]asmVal)
+	}
+
 	// Initialize default segments.
 	p.segCodeName = getSegName(codesegname, "_TEXT", model&FarCode != 0)
 	p.segDataName = getSegName(datasegname, "_DATA", model == TCHuge)
@@ -740,10 +981,28 @@ func EQUALS(p *parser, it *item) ErrorList {
 	ret, err := p.syms.evalInt(it.pos, it.params[0])
 	if err.Severity() < ESError {
 		return p.syms.Set(it.sym, *ret, false)
+	} else if refersToRegisters(it.params[0]) {
+		// Register or memory operand, to be substituted into instructions.
+		return p.syms.Set(it.sym, asmExpression(it.params[0]), false)
 	}
 	return err
 }
 
+// refersToRegisters returns whether s contains the name of a register.
+func refersToRegisters(s string) bool {
+	for i := 0; i < len(s); i++ {
+		end := i
+		for end < len(s) && isSymbolChar(s[end]) {
+			end++
+		}
+		if registers[strings.ToUpper(s[i:end])] {
+			return true
+		}
+		i = end
+	}
+	return false
+}
+
 func EQU(p *parser, it *item) (err ErrorList) {
 	var existing asmVal
 	tryNumber := true
@@ -762,7 +1021,11 @@ func EQU(p *parser, it *item) (err ErrorList) {
 			return err.AddL(p.syms.Set(it.sym, *number, true))
 		}
 	}
-	return p.syms.Set(it.sym, asmExpression(it.params[0]), false)
+	expr := asmExpression(it.params[0])
+	if !isExpression(it.pos, expr.Text()) {
+		return p.syms.Set(it.sym, asmText(expr), false)
+	}
+	return p.syms.Set(it.sym, expr, false)
 }
 
 // text evaluates s as a text string used in a conditional directive.
@@ -779,7 +1042,30 @@ func (p *parser) text(s string) (string, ErrorList) {
 		if p.syntax == "MASM" {
 			s = strings.TrimSpace(s)
 		}
-		rb := strings.IndexByte(s, '>')
+		rb := -1
+		var escapes []int // Positions of escaping !s
+		for i, level := 0, 0; i < len(s) && rb == -1; i++ {
+			switch s[i] {
+			case '!':
+				// TASM escapes the next character, JWasm keeps the !.
+				if p.syntax == "TASM" && i+1 < len(s) {
+					escapes = append(escapes, i)
+					i++
+				}
+			case '\'', '"':
+				// Quoted strings can contain angle brackets.
+				if end := strings.IndexByte(s[i+1:], s[i]); end != -1 {
+					i += end + 1
+				}
+			case '<':
+				level++
+			case '>':
+				if level == 0 {
+					rb = i
+				}
+				level--
+			}
+		}
 		if rb == -1 {
 			return fail()
 		} else if rb != len(s)-1 {
@@ -787,20 +1073,35 @@ func (p *parser) text(s string) (string, ErrorList) {
 				"extra characters on line: %s", s[rb+1:],
 			)
 		}
+		if len(escapes) > 0 {
+			ret, start := "", 0
+			for _, esc := range escapes {
+				ret += s[start:esc]
+				start = esc + 1
+			}
+			return ret + s[start:rb], err
+		}
 		return s[:rb], err
 	} else if s[0] == '%' {
 		name := strings.TrimSpace(s[1:])
 		sym, err := p.syms.Get(name)
-		if err != nil {
+		if err.Severity() >= ESError {
 			return "", err
 		}
 		switch sym.(type) {
 		case asmInt:
-			return strconv.FormatInt(sym.(asmInt).n, 10), nil
+			return strconv.FormatInt(sym.(asmInt).n, 10), err
 		case asmExpression:
-			return string(sym.(asmExpression)), nil
+			expr := string(sym.(asmExpression))
+			if len(expr) > 0 && expr[0] == '<' {
+				ret, errText := p.text(expr)
+				return ret, err.AddL(errText)
+			}
+			return expr, err
+		case asmText:
+			return sym.(asmText).Text(), err
 		default:
-			return "", ErrorListF(ESError,
+			return "", err.AddF(ESError,
 				"can't use %s as a text string: %s", sym.Thing(), name,
 			)
 		}
@@ -808,44 +1109,305 @@ func (p *parser) text(s string) (string, ErrorList) {
 	return fail()
 }
 
+// expandTextMacros replaces every %text_macro outside of quoted strings in s
+// with its value.
+func (p *parser) expandTextMacros(s string) (ret string, err ErrorList) {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\'', '"':
+			if end := strings.IndexByte(s[i+1:], s[i]); end != -1 {
+				ret += s[i : i+end+2]
+				i += end + 1
+				continue
+			}
+		case '%':
+			end := i + 1
+			for end < len(s) && isSymbolChar(s[end]) {
+				end++
+			}
+			if end > i+1 {
+				text, errText := p.text(s[i:end])
+				if err = err.AddL(errText); errText.Severity() >= ESError {
+					return s, err
+				}
+				ret += text
+				i = end - 1
+				continue
+			}
+		}
+		ret += s[i : i+1]
+	}
+	return ret, err
+}
+
+// expandAliases replaces every symbol outside of quoted strings in s that
+// refers to a non-numeric equate, such as a register or memory operand
+// defined with EQU or =, with its value.
+func (p *parser) expandAliases(s string) (ret string) {
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\'' || s[i] == '"':
+			if end := strings.IndexByte(s[i+1:], s[i]); end != -1 {
+				ret += s[i : i+end+2]
+				i += end + 1
+				continue
+			}
+		case isSymbolChar(s[i]):
+			end := i + 1
+			for end < len(s) && isSymbolChar(s[end]) {
+				end++
+			}
+			name := s[i:end]
+			i = end - 1
+			// Structure members are never aliases.
+			if len(ret) == 0 || ret[len(ret)-1] != '.' {
+				switch val, _ := p.syms.Lookup(name); val.(type) {
+				case asmExpression:
+					name = val.(asmExpression).Text()
+				case asmText:
+					name = val.(asmText).Text()
+				}
+			}
+			ret += name
+			continue
+		}
+		ret += s[i : i+1]
+	}
+	return ret
+}
+
+// SUBSTR defines a text macro containing the part of the given text that
+// starts at the given 1-based index and runs for the given length, or until
+// the end of the text. The index can point directly behind the text, which
+// results in an empty string, and lengths past the end are clamped.
+func SUBSTR(p *parser, it *item) ErrorList {
+	text, err := p.text(it.params[0])
+	if err.Severity() >= ESError {
+		return err
+	}
+	start, errStart := p.syms.evalInt(it.pos, it.params[1])
+	err = err.AddL(errStart)
+	if errStart.Severity() >= ESError {
+		return err
+	} else if start.n < 1 || start.n > int64(len(text))+1 {
+		return err.AddF(ESError,
+			"SUBSTR start index out of range (1-%d): %d",
+			len(text)+1, start.n,
+		)
+	}
+	text = text[start.n-1:]
+	if len(it.params) > 2 {
+		length, errLength := p.syms.evalInt(it.pos, it.params[2])
+		err = err.AddL(errLength)
+		if errLength.Severity() >= ESError {
+			return err
+		} else if length.n < 0 {
+			return err.AddF(ESError,
+				"SUBSTR length can't be negative: %d", length.n,
+			)
+		} else if length.n > int64(len(text)) {
+			err = err.AddF(ESWarning,
+				"SUBSTR length runs past the end of the text, clamping to %d: %d",
+				len(text), length.n,
+			)
+		} else {
+			text = text[:length.n]
+		}
+	}
+	// Storing the result as an expression would require it to be quoted,
+	// which breaks as soon as it contains a >.
+	return err.AddL(p.syms.Set(it.sym, asmText(text), false))
+}
+
+// INSTR sets its symbol to the 1-based position of the second text within
+// the first one, or 0 if it can't be found. The search starts at the 1-based
+// index given in the optional first parameter, which, just like with SUBSTR,
+// can point directly behind the text. An empty second text is found at the
+// start index.
+func INSTR(p *parser, it *item) (err ErrorList) {
+	start := int64(1)
+	params := it.params
+	if len(params) > 2 {
+		startVal, errStart := p.syms.evalInt(it.pos, params[0])
+		err = err.AddL(errStart)
+		if errStart.Severity() >= ESError {
+			return err
+		}
+		start = startVal.n
+		params = params[1:]
+	}
+	text, errText := p.text(params[0])
+	err = err.AddL(errText)
+	substr, errSubstr := p.text(params[1])
+	err = err.AddL(errSubstr)
+	if err.Severity() >= ESError {
+		return err
+	} else if start < 1 || start > int64(len(text))+1 {
+		return err.AddF(ESError,
+			"INSTR start index out of range (1-%d): %d", len(text)+1, start,
+		)
+	}
+	pos := int64(strings.Index(text[start-1:], substr))
+	if pos >= 0 {
+		pos += start
+	} else {
+		pos = 0
+	}
+	return err.AddL(p.syms.Set(it.sym, asmInt{n: pos}, false))
+}
+
+// OUT prints its text parameter to the build log. Since conditional
+// directives are only evaluated in the first pass, the messages are
+// collected there and reported before any error of the second pass.
+func OUT(p *parser, it *item) (err ErrorList) {
+	var text string
+	if len(it.params) > 0 {
+		text = it.params[0]
+		if text[0] == '<' || text[0] == '%' {
+			text, err = p.text(text)
+			if err.Severity() >= ESError {
+				return err
+			}
+		}
+	}
+	return err.AddF(ESDebug, "%s", text)
+}
+
+// IDEAL switches to TASM's Ideal mode.
+func IDEAL(p *parser, it *item) ErrorList {
+	if p.syntax != "TASM" {
+		return ErrorListF(ESWarning,
+			"%s is only supported by TASM, ignoring", it.val,
+		)
+	}
+	p.ideal = true
+	return nil
+}
+
+// listingPage describes the pagination of the listing file.
+type listingPage struct {
+	length  uint // Lines per page, or 0 for the default
+	width   uint // Characters per line, or 0 for the default
+	section uint // Number of PAGE + directives so far
+	page    uint // Number of page breaks within the current section
+}
+
+// PAGE either starts a new page, starts a new section if its only parameter
+// is +, or sets the page length and width to the given values, if present.
+func PAGE(p *parser, it *item) (err ErrorList) {
+	if len(it.params) == 0 {
+		p.page.page++
+		return nil
+	} else if strings.TrimSpace(it.params[0]) == "+" {
+		p.page.section++
+		p.page.page = 0
+		return nil
+	}
+	dimensions := []struct {
+		name     string
+		min, max int64
+		dst      *uint
+	}{
+		{"length", 10, 255, &p.page.length},
+		{"width", 60, 255, &p.page.width},
+	}
+	// The length can be left empty to only set the width, as in PAGE ,132,
+	// so the parameters are split here rather than by the lexer.
+	params := strings.Split(it.params[0], ",")
+	if extra := len(params) - len(dimensions); extra > 0 {
+		err = err.AddF(ESWarning,
+			"PAGE accepts a maximum of %d parameters, ignoring %d additional ones: %s",
+			len(dimensions), extra, strings.Join(params[len(dimensions):], ","),
+		)
+	}
+	for i, dim := range dimensions {
+		if i >= len(params) {
+			break
+		} else if strings.TrimSpace(params[i]) == "" {
+			continue
+		}
+		val, errVal := p.syms.evalInt(it.pos, params[i])
+		err = err.AddL(errVal)
+		if errVal.Severity() >= ESError {
+			continue
+		} else if val.n < dim.min || val.n > dim.max {
+			err = err.AddF(ESWarning,
+				"page %s out of range (%d-%d), ignoring: %d",
+				dim.name, dim.min, dim.max, val.n,
+			)
+			continue
+		}
+		*dim.dst = uint(val.n)
+	}
+	return err
+}
+
 func (p *parser) isBlank(s string) (bool, ErrorList) {
 	ret, err := p.text(s)
 	return len(ret) == 0, err
 }
 
+// comparedText returns the text of s as compared by IFIDN and IFDIF, which
+// also expands all %text_macros inside <text strings>. Those can contain
+// commas, and would therefore be split into separate parameters if they were
+// used on their own.
+func (p *parser) comparedText(s string) (string, ErrorList) {
+	ret, err := p.text(s)
+	if err.Severity() < ESError && s[0] == '<' {
+		var errExpand ErrorList
+		ret, errExpand = p.expandTextMacros(ret)
+		err = err.AddL(errExpand)
+	}
+	return ret, err
+}
+
 func (p *parser) isEqual(s1, s2 string) (bool, ErrorList) {
-	ret1, err1 := p.text(s1)
-	ret2, err2 := p.text(s2)
+	ret1, err1 := p.comparedText(s1)
+	ret2, err2 := p.comparedText(s2)
 	return ret1 == ret2, err1.AddL(err2)
 }
 
 func (p *parser) isEqualFold(s1, s2 string) (bool, ErrorList) {
-	ret1, err1 := p.text(s1)
-	ret2, err2 := p.text(s2)
+	ret1, err1 := p.comparedText(s1)
+	ret2, err2 := p.comparedText(s2)
 	return strings.EqualFold(ret1, ret2), err1.AddL(err2)
 }
 
-func (p *parser) evalIf(match bool) ErrorList {
-	valid := match && p.ifMatch == p.ifNest
+// ifCond evaluates the condition of a conditional directive. It is only
+// called if the result actually matters, so that blocks nested inside a
+// skipped block are only counted, but never evaluated.
+type ifCond func() (bool, ErrorList)
+
+// evalIf opens a new conditional block. Failing conditions count as false, to
+// keep the nesting level intact.
+func (p *parser) evalIf(cond ifCond) (err ErrorList) {
+	var match bool
+	if p.ifMatch == p.ifNest {
+		match, err = cond()
+	}
+	valid := match && err.Severity() < ESError
 	if valid {
 		p.ifMatch++
 	}
 	p.ifNest++
 	p.ifElse = !valid
-	return nil
+	return err
 }
 
-func (p *parser) evalElseif(directive string, match bool) ErrorList {
+func (p *parser) evalElseif(directive string, cond ifCond) (err ErrorList) {
 	if p.ifNest == 0 {
 		return ErrorListF(ESWarning, "unmatched %s", directive)
 	}
 	if p.ifMatch == p.ifNest {
 		p.ifMatch--
-	} else if p.ifMatch == (p.ifNest-1) && p.ifElse && match {
-		p.ifMatch++
-		p.ifElse = false
+	} else if p.ifMatch == (p.ifNest-1) && p.ifElse {
+		var match bool
+		if match, err = cond(); match && err.Severity() < ESError {
+			p.ifMatch++
+			p.ifElse = false
+		}
 	}
-	return nil
+	return err
 }
 
 type ifidnMode struct {
@@ -862,74 +1424,95 @@ var ifidnModeMap = map[string]ifidnMode{
 	"IFDIFI": {compareFn: (*parser).isEqualFold, identical: false},
 }
 
+func ifdefCond(p *parser, it *item, mode bool) ifCond {
+	return func() (bool, ErrorList) {
+		val, err := p.syms.Lookup(it.params[0])
+		defined := val != nil || isReserved(it.params[0])
+		return defined == mode, err
+	}
+}
+
+func ifCondition(p *parser, it *item, mode bool) ifCond {
+	return func() (bool, ErrorList) {
+		if hasBlankArg(it.pos, it.params[0]) {
+			return mode, nil
+		}
+		ret, err := p.syms.evalBool(it.pos, it.params[0])
+		return ret == mode, err
+	}
+}
+
+func ifbCond(p *parser, it *item, mode bool) ifCond {
+	return func() (bool, ErrorList) {
+		ret, err := p.isBlank(it.params[0])
+		return ret == mode, err
+	}
+}
+
+func ifidnCond(p *parser, it *item, mode ifidnMode) ifCond {
+	return func() (bool, ErrorList) {
+		ret, err := mode.compareFn(p, it.params[0], it.params[1])
+		return ret == mode.identical, err
+	}
+}
+
 func IFDEF(p *parser, it *item) ErrorList {
-	mode := it.val == "IFDEF"
-	val, err := p.syms.Lookup(it.params[0])
-	return err.AddL(p.evalIf((val != nil) == mode))
+	return p.evalIf(ifdefCond(p, it, it.val == "IFDEF"))
 }
 
 func IF(p *parser, it *item) ErrorList {
-	mode := it.val == "IF"
-	ret, err := p.syms.evalBool(it.pos, it.params[0])
-	return err.AddL(p.evalIf(ret == mode))
+	return p.evalIf(ifCondition(p, it, it.val == "IF"))
 }
 
 func IFB(p *parser, it *item) ErrorList {
-	mode := it.val == "IFB"
-	ret, err := p.isBlank(it.params[0])
-	if err.Severity() >= ESError {
-		return err
-	}
-	return p.evalIf(ret == mode)
+	return p.evalIf(ifbCond(p, it, it.val == "IFB"))
 }
 
 func IFIDN(p *parser, it *item) ErrorList {
-	mode := ifidnModeMap[it.val]
-	ret, err := mode.compareFn(p, it.params[0], it.params[1])
-	if err.Severity() >= ESError {
-		return err
-	}
-	return p.evalIf(ret == mode.identical)
+	return p.evalIf(ifidnCond(p, it, ifidnModeMap[it.val]))
 }
 
 func ELSEIFDEF(p *parser, it *item) ErrorList {
-	mode := it.val == "ELSEIFDEF"
-	val, err := p.syms.Lookup(it.params[0])
-	return err.AddL(p.evalElseif(it.val, (val != nil) == mode))
+	cond := ifdefCond(p, it, it.val == "ELSEIFDEF")
+	return p.evalElseif(it.val, cond)
 }
 
 func ELSEIF(p *parser, it *item) ErrorList {
-	mode := it.val == "ELSEIF"
-	ret, err := p.syms.evalBool(it.pos, it.params[0])
-	return err.AddL(p.evalElseif(it.val, ret == mode))
+	return p.evalElseif(it.val, ifCondition(p, it, it.val == "ELSEIF"))
 }
 
 func ELSEIFB(p *parser, it *item) ErrorList {
-	mode := it.val == "ELSEIFB"
-	ret, err := p.isBlank(it.params[0])
-	if err.Severity() >= ESError {
-		return err
-	}
-	return p.evalElseif(it.val, ret == mode)
+	return p.evalElseif(it.val, ifbCond(p, it, it.val == "ELSEIFB"))
 }
 
 func ELSEIFIDN(p *parser, it *item) ErrorList {
-	mode := ifidnModeMap[it.val[4:]]
-	ret, err := mode.compareFn(p, it.params[0], it.params[1])
-	if err.Severity() >= ESError {
-		return err
-	}
-	return p.evalElseif(it.val, ret == mode.identical)
+	cond := ifidnCond(p, it, ifidnModeMap[it.val[4:]])
+	return p.evalElseif(it.val, cond)
 }
 
 func ELSE(p *parser, it *item) ErrorList {
-	return p.evalElseif("ELSE", true)
+	if b := p.passBlock(); b != nil {
+		// The remaining pass, if there is exactly one.
+		switch {
+		case b.covered[1] && !b.covered[2]:
+			p.passBranch(2)
+		case b.covered[2] && !b.covered[1]:
+			p.passBranch(1)
+		default:
+			p.passBranch(0)
+		}
+		return nil
+	}
+	return p.evalElseif("ELSE", func() (bool, ErrorList) { return true, nil })
 }
 
 func ENDIF(p *parser, it *item) ErrorList {
 	if p.ifNest == 0 {
 		return ErrorListF(ESWarning, "found ENDIF without a matching condition")
 	}
+	if p.passBlock() != nil {
+		p.passBlocks = p.passBlocks[:len(p.passBlocks)-1]
+	}
 	if p.ifMatch == p.ifNest {
 		p.ifMatch--
 		p.ifElse = false
@@ -938,6 +1521,95 @@ func ENDIF(p *parser, it *item) ErrorList {
 	return nil
 }
 
+// passBlock is a conditional block opened by IF1 or IF2 in pass 1. Its
+// branches can be evaluated in pass 1, deferred to pass 2, or never
+// evaluated.
+type passBlock struct {
+	nest    int     // Nesting level of the block
+	pass    int     // Pass of the current branch, or 0 for none
+	covered [3]bool // Passes already covered by a previous branch
+}
+
+// curPass returns the number of the current pass.
+func (p *parser) curPass() int {
+	if p.pass2 {
+		return 2
+	}
+	return 1
+}
+
+// passBlock returns the innermost IF1 or IF2 block if the current nesting
+// level belongs to it, or nil otherwise.
+func (p *parser) passBlock() *passBlock {
+	if len(p.passBlocks) == 0 {
+		return nil
+	}
+	b := &p.passBlocks[len(p.passBlocks)-1]
+	if b.nest != p.ifNest {
+		return nil
+	}
+	return b
+}
+
+// deferred returns whether the current item is part of a branch that is only
+// evaluated in pass 2, while still being in pass 1.
+func (p *parser) deferred() bool {
+	if p.pass2 || len(p.passBlocks) == 0 {
+		return false
+	}
+	return p.passBlocks[len(p.passBlocks)-1].pass == 2
+}
+
+// passBranch starts a new branch of the current IF1 or IF2 block that is
+// evaluated in the given pass. Passes that were already covered by a
+// previous branch are never evaluated again.
+func (p *parser) passBranch(pass int) {
+	b := p.passBlock()
+	if b.covered[pass] {
+		pass = 0
+	}
+	b.pass = pass
+	b.covered[pass] = true
+	p.ifMatch = p.ifNest - 1
+	if pass == 1 {
+		p.ifMatch = p.ifNest
+	}
+	p.ifElse = false
+}
+
+// IFPASS implements IF1 and IF2. Pass 2 only evaluates the instructions kept
+// in pass 1, so IF2 blocks are kept, but not evaluated in pass 1.
+func IFPASS(p *parser, it *item) ErrorList {
+	pass := int(it.val[len(it.val)-1] - '0')
+	if p.pass2 || p.ifMatch != p.ifNest {
+		return p.evalIf(func() (bool, ErrorList) {
+			return pass == p.curPass(), nil
+		})
+	}
+	p.ifNest++
+	p.passBlocks = append(p.passBlocks, passBlock{nest: p.ifNest})
+	p.passBranch(pass)
+	return nil
+}
+
+// ELSEIFPASS implements ELSEIF1 and ELSEIF2.
+func ELSEIFPASS(p *parser, it *item) ErrorList {
+	pass := int(it.val[len(it.val)-1] - '0')
+	if b := p.passBlock(); b != nil {
+		p.passBranch(pass)
+		return nil
+	} else if !p.pass2 && p.ifNest > 0 &&
+		p.ifMatch == p.ifNest-1 && p.ifElse {
+		// All previous branches were false in both passes.
+		p.passBlocks = append(p.passBlocks, passBlock{nest: p.ifNest})
+		p.passBranch(pass)
+		return nil
+	}
+	return p.evalElseif(it.val, func() (bool, ErrorList) {
+		return pass == p.curPass(), nil
+	})
+}
+
 func OPTION(p *parser, it *item) ErrorList {
 	var options = map[string](map[string]func()){
 		"CASEMAP": {
@@ -973,25 +1645,174 @@ func MACRO(p *parser, it *item) ErrorList {
 }
 
 func ENDM(p *parser, it *item) ErrorList {
-	var macro asmMacro
 	var err ErrorList
-	if p.macro.nest == 1 && p.macro.name != "" {
-		macro, err = p.newMacro(it.num)
-		if err.Severity() < ESError {
+	// Without an open block, the counter must not go negative, as that would
+	// stop the evaluation of every following non-macro directive, including
+	// the ENDS that would close a structure.
+	if p.macro.nest == 0 {
+		if len(p.strucs) >= 1 {
+			return ErrorListF(ESError,
+				"structure %s must be closed with ENDS, not ENDM",
+				p.strucs[len(p.strucs)-1].Name(),
+			)
+		}
+		return ErrorListF(ESError, "unmatched ENDM")
+	} else if it.sym != "" {
+		err = ErrorListF(ESWarning, "ignoring name on ENDM: %s", it.sym)
+	}
+	p.macro.nest--
+	if p.macro.nest != 0 {
+		return err
+	} else if p.macro.name != "" {
+		macro, errMacro := p.newMacro(it.num)
+		if err = err.AddL(errMacro); errMacro.Severity() < ESError {
 			err = err.AddL(p.syms.Set(p.macro.name, macro, false))
 		}
 		p.macro.name = ""
+		return err
+	}
+	header := p.instructions[p.macro.start]
+	body := append([]item{}, p.instructions[p.macro.start+1:it.num]...)
+	var expand func() ErrorList
+	var errExpand ErrorList
+	switch header.val {
+	case "REPT", "REPEAT":
+		expand, errExpand = p.expandREPT(&header, body)
+	case "IRP":
+		expand, errExpand = p.expandIRP(&header, body)
+	case "IRPC":
+		expand, errExpand = p.expandIRPC(&header, body)
+	case "WHILE":
+		expand, errExpand = p.expandWHILE(&header, body)
+	}
+	err = err.AddL(errExpand)
+	// The expanded lines have to come after this ENDM in the instruction
+	// list, and are then kept there for pass 2.
+	if !p.pass2 {
+		p.expansion = expand
 	}
-	p.macro.nest--
 	return err
 }
 
 // Placeholder for any non-MACRO block terminated with ENDM
 func DummyMacro(p *parser, it *item) ErrorList {
+	if p.macro.nest == 0 {
+		p.macro.name = ""
+		p.macro.start = it.num
+	}
 	p.macro.nest++
 	return nil
 }
 
+// expandREPT validates the count parameter of the REPT block opened by
+// header, and returns a function that evaluates body that many times.
+func (p *parser) expandREPT(header *item, body []item) (func() ErrorList, ErrorList) {
+	var err ErrorList
+	count, errCount := p.syms.evalInt(header.pos, header.params[0])
+	err = err.AddLAt(header.pos, errCount)
+	if errCount.Severity() >= ESError {
+		return nil, err
+	} else if count.n < 0 {
+		return nil, err.AddFAt(header.pos, ESError,
+			"count must be positive or zero: %s", count,
+		)
+	}
+	return func() (err ErrorList) {
+		for i := int64(0); i < count.n && !p.exitm; i++ {
+			err = err.AddL(p.expandLines(nil, body, nil))
+		}
+		return err
+	}, err
+}
+
+// expandIRP splits the angle-bracketed argument list of the IRP block opened
+// by header, and returns a function that evaluates body once for every
+// argument, substituting it for the block's parameter.
+func (p *parser) expandIRP(header *item, body []item) (func() ErrorList, ErrorList) {
+	var err ErrorList
+	var args []string
+	param := p.syms.ToSymCase(header.params[0])
+	list, errList := p.text(header.params[1])
+	err = err.AddLAt(header.pos, errList)
+	if errList.Severity() >= ESError {
+		return nil, err
+	}
+	for stream := NewLexStreamAt(header.pos, list); stream.peek() != eof; {
+		arg, errArg := p.macroArg(stream.nextParam(0))
+		err = err.AddLAt(header.pos, errArg)
+		args = append(args, arg)
+		stream.next()
+	}
+	return func() (err ErrorList) {
+		for i := 0; i < len(args) && !p.exitm; i++ {
+			replace := p.macroReplacer(map[string]string{param: args[i]})
+			err = err.AddL(p.expandLines(nil, body, replace))
+		}
+		return err
+	}, err
+}
+
+// expandIRPC returns a function that evaluates body once for every character
+// in the string argument of the IRPC block opened by header, substituting it
+// for the block's parameter.
+func (p *parser) expandIRPC(header *item, body []item) (func() ErrorList, ErrorList) {
+	var err ErrorList
+	param := p.syms.ToSymCase(header.params[0])
+	str := header.params[1]
+	if l := len(str); l >= 2 && quotes.matches(str[0]) && str[l-1] == str[0] {
+		str = str[1 : l-1]
+	} else {
+		var errStr ErrorList
+		str, errStr = p.macroArg(str)
+		err = err.AddLAt(header.pos, errStr)
+		if errStr.Severity() >= ESError {
+			return nil, err
+		}
+	}
+	return func() (err ErrorList) {
+		for i := 0; i < len(str) && !p.exitm; i++ {
+			replace := p.macroReplacer(map[string]string{param: str[i : i+1]})
+			err = err.AddL(p.expandLines(nil, body, replace))
+		}
+		return err
+	}, err
+}
+
+// expandWHILE returns a function that evaluates body for as long as the
+// condition of the WHILE block opened by header is true. Since body can modify
+// the symbols used in the condition, it is re-evaluated on every iteration.
+func (p *parser) expandWHILE(header *item, body []item) (func() ErrorList, ErrorList) {
+	var err ErrorList
+	limit := p.opts.MaxWhileIterations
+	if limit <= 0 {
+		limit = defaultMaxWhileIterations
+	}
+	_, errCond := p.syms.evalBool(header.pos, header.params[0])
+	err = err.AddLAt(header.pos, errCond)
+	if errCond.Severity() >= ESError {
+		return nil, err
+	}
+	// The expansion only runs in pass 1, whose non-fatal errors are dropped,
+	// so an aborted loop has to be reported again from here.
+	err = err.AddL(p.loopErrs[header.num])
+	return func() (err ErrorList) {
+		for i := 0; ; i++ {
+			match, errCond := p.syms.evalBool(header.pos, header.params[0])
+			err = err.AddLAt(header.pos, errCond)
+			if !match || errCond.Severity() >= ESError || p.exitm {
+				return err
+			} else if i >= limit {
+				p.loopErrs[header.num] = ErrorListFAt(header.pos, ESError,
+					"WHILE loop exceeded %d iterations, aborting: %s",
+					limit, header.params[0],
+				)
+				return err.AddL(p.loopErrs[header.num])
+			}
+			err = err.AddL(p.expandLines(nil, body, nil))
+		}
+	}, err
+}
+
 // cpuFlag defines the flags for the @CPU value.
 type cpuFlag int
 
@@ -1063,10 +1884,20 @@ func CPU(p *parser, it *item) ErrorList {
 
 func SEGMENT(p *parser, it *item) ErrorList {
 	wordsize := uint8(0)
+	align := uint(0)
 	var attributes = map[string]func(){
 		"USE16": func() { wordsize = 2 },
 		"USE32": func() { wordsize = 4 },
 		"USE64": func() { wordsize = 8 },
+		"BYTE":  func() { align = 1 },
+		"WORD":  func() { align = 2 },
+		"DWORD": func() { align = 4 },
+		"PARA":  func() { align = 16 },
+		"PAGE":  func() { align = 256 },
+	}
+	// Names built by macros aren't necessarily valid.
+	if !isSymbol(it.sym) {
+		return ErrorListF(ESError, "invalid segment name: %s", it.sym)
 	}
 	seg, errList := p.GetSegment(it.sym, false)
 	if errList.Severity() >= ESError {
@@ -1094,6 +1925,9 @@ func SEGMENT(p *parser, it *item) ErrorList {
 	if wordsize != 0 {
 		seg.wordsize = wordsize
 	}
+	if align != 0 {
+		seg.align = align
+	}
 	p.segs = append(p.segs, &asmSegmentBlock{seg: seg})
 	return errList
 }
@@ -1194,6 +2028,49 @@ func SIMSEG(p *parser, it *item) (err ErrorList) {
 	// both modes here. In the end, this is only about showing the correct
 	// nesting warnings and shouldn't break any correct MASM code.
 	p.segs = append(p.segs, &asmSegmentBlock{seg: seg, simplified: true})
+	flat := p.intSyms.Model != nil && *p.intSyms.Model == Flat
+	if segname == p.segCodeName && !flat {
+		// Both assemblers implicitly assume CS here, except for the flat
+		// model.
+		p.assumes["CS"] = seg
+	}
+	return err
+}
+
+func ASSUME(p *parser, it *item) (err ErrorList) {
+	for _, param := range it.params {
+		reg, segname := splitColon(param)
+		reg = strings.ToUpper(reg)
+		if reg == "NOTHING" && segname == "" {
+			p.assumes = make(map[string]asmVal)
+			continue
+		}
+		switch reg {
+		case "CS", "DS", "ES", "SS", "FS", "GS":
+		default:
+			err = err.AddF(ESWarning, "ignoring non-segment register: %s", reg)
+			continue
+		}
+		switch strings.ToUpper(segname) {
+		case "":
+			err = err.AddF(ESError, "missing segment for register: %s", reg)
+			continue
+		case "NOTHING", "ERROR", "FLAT":
+			delete(p.assumes, reg)
+			continue
+		}
+		val, errSeg := p.syms.Get(segname)
+		err = err.AddL(errSeg)
+		switch val.(type) {
+		case nil:
+		case *asmSegment, *asmGroup:
+			p.assumes[reg] = val
+		default:
+			err = err.AddF(ESError,
+				"can't assume %s for a segment register: %s", val.Thing(), segname,
+			)
+		}
+	}
 	return err
 }
 
@@ -1211,7 +2088,12 @@ func ENDS(p *parser, it *item) (err ErrorList) {
 		prevStruc = p.strucs[len(p.strucs)-2].(*asmStruc)
 	}
 
-	if curSegBlock != nil && p.syms.Equal(curSegBlock.seg.name, it.sym) {
+	// TASM also accepts an ENDS without a name for the innermost open
+	// structure or segment.
+	anonymous := p.syntax == "TASM" && it.sym == ""
+
+	segName := curSegBlock != nil && p.syms.Equal(curSegBlock.seg.name, it.sym)
+	if segName || (curSegBlock != nil && curStruc == nil && anonymous) {
 		if curStruc != nil {
 			err = ErrorListOpen(p.strucs)
 			p.strucs = nil
@@ -1224,17 +2106,23 @@ func ENDS(p *parser, it *item) (err ErrorList) {
 		if prevStruc == nil {
 			expSym = curStruc.name
 		}
-		if p.syms.Equal(it.sym, expSym) {
+		if p.syms.Equal(it.sym, expSym) || anonymous {
 			constant := p.syntax != "TASM"
 			if prevStruc == nil {
 				err = p.syms.Set(curStruc.name, *curStruc, constant)
 			} else {
 				ptr := &asmPtr{sym: &curStruc.name, unit: curStruc}
-				err = prevStruc.members.Set(curStruc.name, *curStruc, constant)
+				chunk, off := prevStruc.Offset()
+				member := asmDataPtr{ptr: *ptr, et: prevStruc, chunk: chunk, off: off}
+				err = prevStruc.members.Set(curStruc.name, member, constant)
 				prevStruc.AddData(ptr, curStruc)
 			}
 			p.strucs = p.strucs[:len(p.strucs)-1]
 			return err
+		} else if it.sym == "" {
+			return ErrorListF(ESError,
+				"ENDS of top-level structure requires its name: %s", expSym,
+			)
 		}
 	}
 	return ErrorListF(ESError, "unmatched ENDS: %s", it.sym)
@@ -1255,17 +2143,174 @@ func GROUP(p *parser, it *item) (err ErrorList) {
 	return err
 }
 
+func PUBLIC(p *parser, it *item) (err ErrorList) {
+	for _, param := range it.params {
+		err = err.AddL(p.syms.SetPublic(it.pos, param))
+	}
+	return err
+}
+
+// typeUnit returns the data unit described by the given type name.
+func (p *parser) typeUnit(typ string) (DataUnit, ErrorList) {
+	typUpper := strings.ToUpper(typ)
+	// Structures don't have an address size of their own, so pointers
+	// inside them depend on the segment they are defined in.
+	wordsize := p.intSyms.SegmentWordSize()
+	if len(p.segs) >= 1 {
+		wordsize = p.segs[len(p.segs)-1].(*asmSegmentBlock).seg.WordSize()
+	}
+	if width := p.intSyms.PtrWidth(typUpper, wordsize); width != 0 {
+		return SimpleData(width), nil
+	} else if size, ok := asmTypes[typUpper]; ok && size.n != 0 {
+		return SimpleData(size.n), nil
+	}
+	if val, err := p.syms.Lookup(typ); val != nil {
+		switch val.(type) {
+		case asmStruc:
+			struc := val.(asmStruc)
+			return &struc, err
+		case asmTypedef:
+			return val.(asmTypedef).unit, err
+		}
+	}
+	return nil, ErrorListF(ESError, "invalid type: %s", typ)
+}
+
+// typeExprUnit returns the data unit described by the given type expression,
+// which can also be a pointer type of the form [distance] PTR [type]. Since
+// pointers are only ever emitted as plain numbers, the width of the latter
+// is all we need, which depends on its distance and the memory model.
+func (p *parser) typeExprUnit(typ string) (DataUnit, ErrorList) {
+	words := strings.Fields(typ)
+	ptr := -1
+	for i, word := range words {
+		if strings.ToUpper(word) == "PTR" {
+			ptr = i
+			break
+		}
+	}
+	switch ptr {
+	case -1:
+		return p.typeUnit(typ)
+	case 0:
+		return p.typeUnit("DATAPTR")
+	case 1:
+		if p.intSyms.PtrWidth(strings.ToUpper(words[0]), 2) == 0 {
+			return nil, ErrorListF(ESError,
+				"invalid pointer distance: %s", words[0],
+			)
+		}
+		return p.typeUnit(words[0])
+	}
+	return nil, ErrorListF(ESError, "invalid pointer type: %s", typ)
+}
+
+// asmTypedef represents a type defined using TYPEDEF.
+type asmTypedef struct {
+	def  string // Type expression as given in the source
+	unit DataUnit
+}
+
+func (v asmTypedef) Thing() string {
+	return "type"
+}
+
+func (v asmTypedef) String() string {
+	return fmt.Sprintf("TYPEDEF %s (%d bytes)", v.def, v.unit.Width())
+}
+
+// TYPEDEF defines an alias for a type, or a pointer type.
+func TYPEDEF(p *parser, it *item) (err ErrorList) {
+	unit, err := p.typeExprUnit(it.params[0])
+	if err.Severity() >= ESError {
+		return err
+	}
+	words := strings.Fields(it.params[0])
+	typedef := asmTypedef{def: strings.Join(words, " "), unit: unit}
+	return err.AddL(p.syms.Set(it.sym, typedef, true))
+}
+
+func EXTRN(p *parser, it *item) (err ErrorList) {
+	for _, param := range it.params {
+		name, typ := splitColon(param)
+		if typ == "" {
+			err = err.AddF(ESError, "missing type for external symbol: %s", name)
+			continue
+		}
+		// ABS constants don't refer to any data, and therefore have a
+		// TYPE of 0.
+		var unit DataUnit = SimpleData(0)
+		if strings.ToUpper(typ) != "ABS" {
+			var errType ErrorList
+			unit, errType = p.typeUnit(typ)
+			err = err.AddL(errType)
+			if errType.Severity() >= ESError {
+				continue
+			}
+		}
+		ptr := asmDataPtr{
+			ptr: asmPtr{sym: &name, unit: unit}, external: true,
+		}
+		err = err.AddL(p.syms.Set(name, ptr, true))
+	}
+	return err
+}
+
 func DATA(p *parser, it *item) (err ErrorList) {
 	wordsize := map[string]SimpleData{
 		"DB": 1, "DW": 2, "DD": 4, "DF": 6, "DP": 6, "DQ": 8, "DT": 10,
+		"REAL4": 4, "REAL8": 8, "REAL10": 10,
 	}[it.val]
 	return p.EmitData(it, wordsize)
 }
 
+// ORG moves the location counter of the current segment to the given offset.
+func ORG(p *parser, it *item) ErrorList {
+	off, err := p.syms.evalInt(it.pos, it.params[0])
+	if err.Severity() >= ESError {
+		return err
+	} else if off.n < 0 {
+		return err.AddF(ESError, "ORG offset can't be negative: %d", off.n)
+	}
+	seg, ok := p.CurrentEmissionTarget().(*asmSegment)
+	if !ok {
+		return err.AddF(ESError, "ORG is only supported inside segments")
+	}
+	return err.AddL(seg.SetOrg(uint64(off.n)))
+}
+
+// ALIGN pads the current emission target with null bytes until its location
+// counter is a multiple of the given alignment. EVEN aligns to 2 bytes.
+func ALIGN(p *parser, it *item) (err ErrorList) {
+	align := int64(2)
+	if it.val == "ALIGN" {
+		n, errAlign := p.syms.evalInt(it.pos, it.params[0])
+		if err = err.AddL(errAlign); errAlign.Severity() >= ESError {
+			return err
+		}
+		align = n.n
+	}
+	if align <= 0 || align&(align-1) != 0 {
+		return err.AddF(ESError, "alignment must be a power of 2: %d", align)
+	}
+	et := p.CurrentEmissionTarget()
+	_, off := et.Offset()
+	if pad := (uint64(align) - off%uint64(align)) % uint64(align); pad > 0 {
+		err = err.AddL(et.AddData(nil, asmString(make([]byte, pad))))
+	}
+	return err
+}
+
 func LABEL(p *parser, it *item) ErrorList {
 	size, err := p.syms.evalInt(it.pos, it.params[0])
 	if err.Severity() < ESError {
-		err = err.AddL(p.EmitPointer(it.sym, SimpleData(size.n)))
+		distance := strings.ToUpper(strings.TrimSpace(it.params[0]))
+		switch distance {
+		case "NEAR", "FAR", "PROC", "CODEPTR":
+		default:
+			distance = "DATAPTR"
+		}
+		err = err.AddL(p.EmitPointer(it.sym, SimpleData(size.n), distance))
 	}
 	return err
 }
@@ -1274,13 +2319,35 @@ func LABEL(p *parser, it *item) ErrorList {
 // returns whether to keep it in the parser's instruction list.
 func (p *parser) eval(it *item) (keep bool, err ErrorList) {
 	k, ok := Keywords[it.val]
-	if !(k.Type&Conditional != 0 || (p.ifMatch >= p.ifNest)) {
+	if p.pass2 && it.pass == 1 {
+		return true, err
+	} else if p.deferred() {
+		// Conditionals still need to update the nesting level.
+		if k.Type&Conditional == Conditional {
+			err = k.Func(p, it)
+		}
+		it.pass = 2
+		return p.deferred(), err
+	}
+	if !(k.Type&Conditional == Conditional || (p.ifMatch >= p.ifNest)) {
 		return false, err
 	} else if k.Type&Macro == 0 && p.macro.nest != 0 {
 		return true, err
 	} else if !ok {
 		// Dropping the error on unknown directives/symbols for now
-		if insSym, errSym := p.syms.Get(it.val); errSym == nil {
+		if insSym, errSym := p.syms.Get(it.val); errSym.Severity() >= ESError {
+			// Most likely a CPU instruction.
+			it.operands = make(itemParams, len(it.params))
+			for i := range it.params {
+				operand := p.expandAliases(it.params[i])
+				if p.ideal {
+					var errMembers ErrorList
+					operand, errMembers = p.idealMembers(operand)
+					err = err.AddL(errMembers)
+				}
+				it.operands[i] = operand
+			}
+		} else {
 			switch insSym.(type) {
 			case asmMacro:
 				return p.expandMacro(insSym.(asmMacro), it)
@@ -1290,6 +2357,12 @@ func (p *parser) eval(it *item) (keep bool, err ErrorList) {
 					return p.EmitData(it, &struc)
 				}
 				k = Keyword{fn, Optional, Data | SingleParam, Range{1, 1}}
+			case asmTypedef:
+				unit := insSym.(asmTypedef).unit
+				fn := func(p *parser, it *item) ErrorList {
+					return p.EmitData(it, unit)
+				}
+				k = Keyword{fn, Optional, Data | SingleParam, Range{1, 1}}
 			}
 		}
 	}
@@ -1303,7 +2376,12 @@ func (p *parser) eval(it *item) (keep bool, err ErrorList) {
 		)
 	} else if k.Func != nil {
 		if err = it.checkSyntaxFor(k); err.Severity() < ESError {
-			return k.Type&Evaluated == 0, err.AddL(k.Func(p, it))
+			err = err.AddL(k.Func(p, it))
+			if k.Type&Evaluated != 0 {
+				p.evalErrs = p.evalErrs.AddLAt(it.pos, err)
+				return false, err
+			}
+			return true, err
 		}
 	}
 	return true, err
@@ -1311,49 +2389,164 @@ func (p *parser) eval(it *item) (keep bool, err ErrorList) {
 
 func (p *parser) evalNew(it *item) (err ErrorList) {
 	keep, err := p.eval(it)
+	if n := len(p.passBlocks); n > 0 && p.passBlocks[n-1].pass == 1 {
+		it.pass = 1
+	}
 	if keep {
 		p.instructions = append(p.instructions, *it)
 	}
+	if expansion := p.expansion; expansion != nil {
+		p.expansion = nil
+		err = err.AddL(p.expand(expansion))
+	}
 	return err
 }
 
-func Parse(filename string, syntax string, includePaths []string) (*parser, ErrorList) {
-	p := &parser{syntax: syntax}
-	syms := *NewSymMap(&p.caseSensitive, &p.intSyms)
-	p.syms = syms
-	p.setCPU("8086")
-
-	filenamesym := filepath.Base(filename)
-	if i := strings.IndexByte(filenamesym, '.'); i != -1 {
-		filenamesym = filenamesym[:i]
+// syntaxMarkers maps directives that are only supported by a single
+// assembler to the name of that assembler.
+var syntaxMarkers = map[string]string{
+	"IDEAL":    "TASM",
+	"MASM51":   "TASM",
+	"MODEL":    "TASM",
+	"CODESEG":  "TASM",
+	"DATASEG":  "TASM",
+	"UDATASEG": "TASM",
+	"LOCALS":   "TASM",
+	"JUMPS":    "TASM",
+	"P8086":    "TASM",
+	"P286":     "TASM",
+	"P386":     "TASM",
+	"P486":     "TASM",
+	"OPTION":   "MASM",
+	"TEXTEQU":  "MASM",
+	"ECHO":     "MASM",
+	"FOR":      "MASM",
+	"FORC":     "MASM",
+	"REPEAT":   "MASM",
+	"PROTO":    "MASM",
+	"INVOKE":   "MASM",
+	".IF":      "MASM",
+	".WHILE":   "MASM",
+	".REPEAT":  "MASM",
+}
+
+// detectSyntax returns the assembler whose directive appears first in the
+// given source code, or def if there is no such directive.
+func detectSyntax(input string, def string) string {
+	for _, line := range strings.Split(input, "\n") {
+		if i := strings.IndexByte(line, ';'); i != -1 {
+			line = line[:i]
+		}
+		words := strings.Fields(line)
+		// Directives can come after a symbol name.
+		for i := 0; i < len(words) && i < 2; i++ {
+			if syntax, ok := syntaxMarkers[strings.ToUpper(words[i])]; ok {
+				return syntax
+			}
+		}
 	}
-	p.intSyms.FileName = asmExpression(strings.ToUpper(filenamesym))
-	p.intSyms.FileName8 = asmString(fmt.Sprintf("%-8s", filenamesym)[:8])
-
-	err := p.StepIntoFile(filename, includePaths)
-	if err.Severity() >= ESFatal {
-		return p, err
+	return def
+}
+
+// ParseOptions collects all user-configurable settings of the parser.
+type ParseOptions struct {
+	// Target assembler, or AUTO to detect it from the main file.
+	Syntax       string
+	IncludePaths []string
+	// Report every unknown symbol only once at the end, together with all
+	// of its use sites?
+	DeferUnresolved bool
+	// Default word size in bytes for code that doesn't set a CPU, or 0 for
+	// the 8086 default.
+	WordSize uint8
+	// Maximum number of iterations of a single WHILE loop, or 0 for
+	// defaultMaxWhileIterations.
+	MaxWhileIterations int
+	// Maximum nesting level of INCLUDE directives, or 0 for
+	// defaultMaxIncludeDepth.
+	MaxIncludeDepth int
+	// Maximum nesting level of macro expansions, or 0 for
+	// defaultMaxMacroDepth.
+	MaxMacroDepth int
+	// Abort parsing once this many errors have been accumulated, or 0 for
+	// no limit. Warnings and debug messages don't count.
+	MaxErrors int
+}
+
+const defaultMaxWhileIterations = 100000
+const defaultMaxIncludeDepth = 50
+const defaultMaxMacroDepth = 256
+
+// limitErrors returns a fatal error if err contains at least as many errors
+// as the user allows.
+func (p *parser) limitErrors(err ErrorList) ErrorList {
+	max := p.opts.MaxErrors
+	if max > 0 && err.Count(ESError) >= max {
+		return ErrorListF(ESFatal, "too many errors (%d), aborting", max)
 	}
+	return nil
+}
 
-	// Pass 1; any non-fatal errors are ignored
-	p.pass2 = false
-	for p.file != nil && err.Severity() < ESFatal {
+// lexFiles runs pass 1 over all items in the current file and the files that
+// included it, until all of them have been read.
+func (p *parser) lexFiles() (err ErrorList) {
+	for p.file != nil {
 		it, errLex := p.lexItem(&p.file.stream)
 		if errLex.Severity() >= ESFatal {
-			return p, errLex
+			return errLex
 		} else if it != nil {
 			it.num = len(p.instructions)
 			if errEval := p.evalNew(it); errEval.Severity() >= ESFatal {
-				return p, err.AddLAt(it.pos, errEval)
+				return err.AddLAt(it.pos, errEval)
+			} else if errLimit := p.limitErrors(p.evalErrs); errLimit != nil {
+				return p.evalErrs.AddLAt(it.pos, errLimit)
 			}
 		} else {
 			p.file = p.file.prev
 		}
 	}
+	return err
+}
+
+// Run evaluates the given items, followed by the current file, if any, in
+// pass 1, then evaluates the resulting instruction list again in pass 2, with
+// the offsets of all data declarations known from pass 1. Returns the errors
+// of both passes.
+func (p *parser) Run(items []item) (err ErrorList) {
+	// Pass 1; any non-fatal errors are ignored
+	p.pass2 = false
+	for i := range items {
+		it := &items[i]
+		it.num = len(p.instructions)
+		if errEval := p.evalNew(it); errEval.Severity() >= ESFatal {
+			return err.AddLAt(it.pos, errEval)
+		} else if errLimit := p.limitErrors(p.evalErrs); errLimit != nil {
+			return p.evalErrs.AddLAt(it.pos, errLimit)
+		}
+		// INCLUDE directives
+		if err = err.AddL(p.lexFiles()); err.Severity() >= ESFatal {
+			return err
+		}
+	}
+	if err = err.AddL(p.lexFiles()); err.Severity() >= ESFatal {
+		return err
+	}
 	// Clear the state of nested blocks before starting the next pass.
 	// Otherwise, we'd report all unclosed segments once per pass.
 	p.segs = nil
 	p.strucs = nil
+	p.assumes = make(map[string]asmVal)
+	p.page = listingPage{}
+	p.ideal = false
+	p.passBlocks = nil
+	err = err.AddL(p.evalErrs)
+	// The data is emitted again in pass 2.
+	for _, sym := range p.syms.Map {
+		switch sym.Val.(type) {
+		case *asmSegment:
+			sym.Val.(*asmSegment).Reset()
+		}
+	}
 
 	// Pass 2
 	p.pass2 = true
@@ -1361,17 +2554,71 @@ func Parse(filename string, syntax string, includePaths []string) (*parser, Erro
 		_, errEval := p.eval(&p.instructions[i])
 		err = err.AddLAt(p.instructions[i].pos, errEval)
 		if errEval.Severity() >= ESFatal {
-			return p, err
+			return err
+		} else if errLimit := p.limitErrors(err); errLimit != nil {
+			return err.AddLAt(p.instructions[i].pos, errLimit)
 		}
 	}
+	// Instructions that were only evaluated in pass 1 are not part of the
+	// final program.
+	kept := p.instructions[:0]
+	for _, it := range p.instructions {
+		if it.pass != 1 {
+			kept = append(kept, it)
+		}
+	}
+	p.instructions = kept
+	return err
+}
+
+func Parse(filename string, opts ParseOptions) (*parser, ErrorList) {
+	p := &parser{
+		opts:     opts,
+		syntax:   opts.Syntax,
+		assumes:  make(map[string]asmVal),
+		loopErrs: make(map[int]ErrorList),
+	}
+	syms := *NewSymMap(&p.caseSensitive, &p.intSyms)
+	p.syms = syms
+	switch opts.WordSize {
+	case 4:
+		p.setCPU("386")
+	case 8:
+		p.setCPU("X64")
+	default:
+		p.setCPU("8086")
+	}
+
+	filenamesym := filepath.Base(filename)
+	if i := strings.IndexByte(filenamesym, '.'); i != -1 {
+		filenamesym = filenamesym[:i]
+	}
+	p.intSyms.FileName = asmExpression(strings.ToUpper(filenamesym))
+	p.intSyms.FileName8 = asmString(fmt.Sprintf("%-8s", filenamesym)[:8])
+	p.intSyms.Location = p.location
+
+	err := p.StepIntoFile(filename, opts.IncludePaths)
+	if err.Severity() >= ESFatal {
+		return p, err
+	} else if p.syntax == "AUTO" {
+		p.syntax = detectSyntax(p.file.stream.input, "TASM")
+	}
+
+	if err = err.AddL(p.Run(nil)); err.Severity() >= ESFatal {
+		return p, err.Collapse()
+	}
 
 	posEOF := NewItemPos(&filename, 0)
 	err = err.AddLAt(posEOF, ErrorListOpen(p.strucs))
 	err = err.AddLAt(posEOF, ErrorListOpen(p.segs))
+	err = err.AddL(p.syms.UndefinedPublics())
 	if p.proc.nest != 0 {
 		err = err.AddFAt(posEOF, ESWarning,
 			"ignoring procedure without an ENDP directive: %s", p.proc.name,
 		)
 	}
-	return p, err
+	if opts.DeferUnresolved {
+		err = err.GroupUnresolved(posEOF)
+	}
+	return p, err.Collapse()
 }
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestMacroDepthLimit(t *testing.T) {
+	tests := []struct {
+		src string
+		err string
+	}{
+		{"rec macro n\n\trec n\nendm\nrec 1\n", "macro expansion depth exceeds 16"},
+		{"a macro\n\tb\nendm\nb macro\n\ta\nendm\na\n", "macro expansion depth exceeds 16"},
+		{"cnt = 8\nm macro\n\tcnt = cnt - 1\n\tif cnt\n\tm\n\tendif\nendm\nm\n", ""},
+	}
+	for _, test := range tests {
+		p, err := parseString(t, test.src, ParseOptions{MaxMacroDepth: 16})
+		checkErrors(t, err, ESError, test.err)
+		if e := findError(err, ESError, "depth"); e != nil && len(e.pos) > 2 {
+			t.Errorf("position chain not shortened: %s", e.pos)
+		}
+		for _, it := range p.instructions {
+			val, _ := p.syms.Lookup(it.val)
+			if _, ok := val.(asmMacro); ok && it.generated {
+				t.Errorf("invocation kept in instruction list: %s", it)
+			}
+		}
+	}
+}
+
+func TestMaxErrors(t *testing.T) {
+	src := "ideal\nideal\nideal\nx = 1 / 0\nideal\ny = 1 / 0\nz = 1 / 0\nideal\n"
+	_, err := parseString(t, src, ParseOptions{MaxErrors: 2})
+	var warnings, errors, fatals int
+	for _, e := range err {
+		switch {
+		case e.sev == ESWarning:
+			warnings++
+		case e.sev == ESError && strings.Contains(e.s, "division by zero"):
+			errors++
+		case e.sev == ESFatal && strings.Contains(e.s, "too many errors (2)"):
+			fatals++
+		default:
+			t.Errorf("unexpected error: %s", e.s)
+		}
+	}
+	if warnings != 4 || errors != 2 || fatals != 1 {
+		t.Errorf("got %d warnings, %d errors and %d fatal errors, want 4, 2 and 1:\n%s",
+			warnings, errors, fatals, errorsString(err),
+		)
+	}
+
+	// Without the limit, parsing goes on until the end.
+	_, err = parseString(t, src, ParseOptions{})
+	if got := err.Count(ESError); got != 3 || err.Severity() >= ESFatal {
+		t.Errorf("got %d errors without a limit, want 3:\n%s", got, errorsString(err))
+	}
+}
+
+func TestMacroConditions(t *testing.T) {
+	src := "m macro a\n" +
+		"\tif a eq 0\n\tdb 1\n\telse\n\tdb a\n\tendif\n" +
+		"\tife a\n\tdb 2\n\tendif\n" +
+		"endm\n" +
+		"d segment\n%s\nd ends\n"
+	tests := []struct {
+		call string
+		want []byte
+	}{
+		{"m 0", []byte{1, 2}},
+		{"m 5", []byte{5}},
+		{"m 2 + 3", []byte{5}},
+		{"m", []byte{1}},
+		{"m <>", []byte{1}},
+	}
+	for _, test := range tests {
+		p, err := parseString(t, fmt.Sprintf(src, test.call), ParseOptions{})
+		checkErrors(t, err, ESWarning, "")
+		if got := segmentBytes(t, p, "d"); !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got % x, want % x", test.call, got, test.want)
+		}
+	}
+}
+
+func TestPassConditionals(t *testing.T) {
+	tests := []struct {
+		src    string
+		cnt    int64
+		want   []byte
+		hidden string
+	}{
+		{"cnt = 0\nd segment\nif1\ncnt = cnt + 1\ndb 1\nendif\nd ends\n", 0, nil, "DB\t1"},
+		{"cnt = 0\nd segment\nif2\ncnt = cnt + 1\ndb 2\nendif\nd ends\n", 1, []byte{2}, ""},
+		{"cnt = 0\nd segment\nif1\ndb 1\nelse\ncnt = cnt + 1\ndb 2\nendif\nd ends\n", 1, []byte{2}, "DB\t1"},
+		{"cnt = 0\nd segment\nif2\ndb 2\nelseif1\ncnt = 5\ndb 1\nendif\nd ends\n", 0, []byte{2}, "DB\t1"},
+	}
+	for _, test := range tests {
+		p, err := parseString(t, test.src, ParseOptions{})
+		checkErrors(t, err, ESWarning, "")
+		if got := symInt(t, p, "cnt"); got != test.cnt {
+			t.Errorf("%q: cnt = %d, want %d", test.src, got, test.cnt)
+		}
+		if got := segmentBytes(t, p, "d"); !bytes.Equal(got, test.want) {
+			t.Errorf("%q: got % x, want % x", test.src, got, test.want)
+		}
+		if test.hidden == "" {
+			continue
+		}
+		for _, instructions := range [][]item{p.instructions, Expanded(p.instructions)} {
+			var buf bytes.Buffer
+			EmitAsm(&buf, instructions, 0)
+			if strings.Contains(buf.String(), test.hidden) {
+				t.Errorf("%q: pass 1 code in output:\n%s", test.src, buf.String())
+			}
+		}
+	}
+}
+
+func TestIdealMode(t *testing.T) {
+	src := "d segment\ndb 1\nd ends\nideal\nsegment e\ndb 2\nends e\n"
+	p, err := parseString(t, src, ParseOptions{Syntax: "TASM"})
+	checkErrors(t, err, ESWarning, "")
+	for seg, want := range map[string][]byte{"d": {1}, "e": {2}} {
+		if got := segmentBytes(t, p, seg); !bytes.Equal(got, want) {
+			t.Errorf("%s: got % x, want % x", seg, got, want)
+		}
+	}
+}
+
+func TestIRPC(t *testing.T) {
+	tests := []struct {
+		block string
+		want  []byte
+	}{
+		{"irpc x, 123\ndb x\nendm\n", []byte{1, 2, 3}},
+		{"irpc x, <45>\ndb x\nendm\n", []byte{4, 5}},
+		{"irpc x, '67'\ndb x\nendm\n", []byte{6, 7}},
+		{"irpc c, ABC\ndb '&c'\nendm\n", []byte("ABC")},
+		{"irpc x, <>\ndb x\nendm\n", nil},
+	}
+	for _, test := range tests {
+		p, err := parseString(t, "d segment\n"+test.block+"d ends\n", ParseOptions{})
+		checkErrors(t, err, ESWarning, "")
+		if got := segmentBytes(t, p, "d"); !bytes.Equal(got, test.want) {
+			t.Errorf("%q: got % x, want % x", test.block, got, test.want)
+		}
+	}
+}
+
+func TestDefaultWordSize(t *testing.T) {
+	for _, size := range []uint8{0, 2, 4, 8} {
+		want := size
+		if want == 0 {
+			want = 2
+		}
+		src := "d segment\nws = @WordSize\nd ends\n"
+		p, err := parseString(t, src, ParseOptions{WordSize: size})
+		checkErrors(t, err, ESWarning, "")
+		val, _ := p.syms.Get("d")
+		if seg := val.(*asmSegment); seg.wordsize != want {
+			t.Errorf("word size %d: segment has %d bytes", size, seg.wordsize)
+		}
+		if got := symInt(t, p, "ws"); got != int64(want) {
+			t.Errorf("word size %d: @WordSize = %d", size, got)
+		}
+	}
+}
+
+func TestFlatModel(t *testing.T) {
+	src := ".386\n.model flat\n" +
+		".code\ncs = @CodeSize\n.data\nds = @DataSize\n" +
+		"d segment\nd ends\n"
+	p, err := parseString(t, src, ParseOptions{})
+	checkErrors(t, err, ESWarning, "")
+	for _, name := range []string{"_TEXT", "_DATA", "d"} {
+		val, _ := p.syms.Get(name)
+		if seg, ok := val.(*asmSegment); !ok {
+			t.Errorf("%s is not a segment: %v", name, val)
+		} else if seg.wordsize != 4 {
+			t.Errorf("%s has %d-byte offsets, want 4", name, seg.wordsize)
+		}
+	}
+	for _, name := range []string{"cs", "ds"} {
+		if got := symInt(t, p, name); got != 0 {
+			t.Errorf("%s = %d, want 0", name, got)
+		}
+	}
+	if cs, ok := p.assumes["CS"]; ok {
+		t.Errorf("CS is assumed to be %v", cs)
+	}
+}
+
+func TestMacroAdjacentParameters(t *testing.T) {
+	tests := []struct {
+		line       string
+		tasm, masm string
+	}{
+		{"mov ax, p+1", "foo+1", "foo+1"},
+		{"mov ax, [p]", "[foo]", "[foo]"},
+		{"mov ax, p.x", "foo.x", "p.x"},
+		{"mov ax, x.p", "x.foo", "x.p"},
+		{"mov ax, p&y", "fooy", "fooy"},
+		{"mov ax, py", "py", "py"},
+	}
+	for _, test := range tests {
+		src := "m macro p\n\t" + test.line + "\nendm\nc segment\nm foo\nc ends\n"
+		for syntax, want := range map[string]string{"TASM": test.tasm, "MASM": test.masm} {
+			p, err := parseString(t, src, ParseOptions{Syntax: syntax})
+			checkErrors(t, err, ESWarning, "")
+			var buf bytes.Buffer
+			EmitAsm(&buf, Expanded(p.instructions), 0)
+			checkOutput(t, buf.String(), []string{"mov\tax, " + want + "\n"})
+		}
+	}
+}
+
+func TestSkippedBlocks(t *testing.T) {
+	var skipped strings.Builder
+	for i := 0; i < 200; i++ {
+		skipped.WriteString("s" + fmt.Sprint(i) + " segment\ndb 1\n")
+		skipped.WriteString("if undefined_symbol\nelseif 1 / 0\nelse\ndb 2\nendif\n")
+		skipped.WriteString("m" + fmt.Sprint(i) + " macro\nif undefined_symbol\nendif\nendm\n")
+		skipped.WriteString("s" + fmt.Sprint(i) + " ends\n")
+	}
+	src := "d segment\nif 0\n" + skipped.String() + "db 3\nelse\ndb 4\nendif\n" +
+		"ife 1\nif 1 / 0\nendif\nelseif 1\ndb 5\nendif\nd ends\n"
+	p, err := parseString(t, src, ParseOptions{})
+	checkErrors(t, err, ESWarning, "")
+	if got := segmentBytes(t, p, "d"); !bytes.Equal(got, []byte{4, 5}) {
+		t.Errorf("got % x, want 04 05", got)
+	}
+	if val, _ := p.syms.Lookup("s0"); val != nil {
+		t.Errorf("segment inside skipped block defined as %s", val.Thing())
+	}
+}
+
+func TestPAGE(t *testing.T) {
+	tests := []struct {
+		src  string
+		want listingPage
+		err  string
+	}{
+		{"page 60, 132\n", listingPage{length: 60, width: 132}, ""},
+		{"page 60, 132\npage\npage\n", listingPage{length: 60, width: 132, page: 2}, ""},
+		{"page\npage +\n", listingPage{section: 1}, ""},
+		{"page +\npage\npage +\npage\n", listingPage{section: 2, page: 1}, ""},
+		{"page , 80\n", listingPage{width: 80}, ""},
+		{"page 50,\n", listingPage{length: 50}, ""},
+		{"page 50, 80, 1\n", listingPage{length: 50, width: 80}, "ignoring 1 additional ones"},
+		{"page 5, 300\n", listingPage{}, "page length out of range"},
+		{"page 5, 300\n", listingPage{}, "page width out of range"},
+	}
+	for _, test := range tests {
+		p, err := parseString(t, test.src, ParseOptions{})
+		checkErrors(t, err, ESWarning, test.err)
+		if p.page != test.want {
+			t.Errorf("%q: got %+v, want %+v", test.src, p.page, test.want)
+		}
+	}
+}
+
+func TestAutoSyntax(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"ideal\nmodel small\ncodeseg\nend\n", "TASM"},
+		{"; option casemap:none\n\tjumps\n", "TASM"},
+		{"x textequ <1>\n.model small\n.code\nend\n", "MASM"},
+		{"\toption casemap:none\n\tideal\n", "MASM"},
+		{".model small\n.code\nend\n", "TASM"},
+	}
+	for _, test := range tests {
+		if got := detectSyntax(test.src, "TASM"); got != test.want {
+			t.Errorf("%q: detected %s, want %s", test.src, got, test.want)
+		}
+		p, _ := parseString(t, test.src, ParseOptions{Syntax: "AUTO"})
+		if p.syntax != test.want {
+			t.Errorf("%q: parsed as %s, want %s", test.src, p.syntax, test.want)
+		}
+	}
+}
+
+func TestGeneratedItems(t *testing.T) {
+	src := "m macro\n\tdb 1\nendm\n" +
+		"d segment\ndb 0\nm\nrept 2\ndb 2\nendm\nirp x, <3>\ndb x\nendm\nd ends\n"
+	p, err := parseString(t, src, ParseOptions{})
+	checkErrors(t, err, ESWarning, "")
+	var generated []string
+	for _, it := range p.instructions {
+		if it.generated {
+			generated = append(generated, it.String())
+		} else if it.val == "DB" && len(it.pos) != 1 {
+			t.Errorf("expanded item not flagged: %s", it)
+		}
+	}
+	want := []string{"\tDB\t1", "\tDB\t2", "\tDB\t2", "\tDB\t3"}
+	if strings.Join(generated, "\n") != strings.Join(want, "\n") {
+		t.Errorf("generated items:\n%s\nwant:\n%s",
+			strings.Join(generated, "\n"), strings.Join(want, "\n"),
+		)
+	}
+}
+
+func TestTextEscapes(t *testing.T) {
+	tests := []struct {
+		syntax, s string
+		want      string
+		err       string
+	}{
+		{"TASM", "<a !> b>", "a > b", ""},
+		{"TASM", "<!<x!>>", "<x>", ""},
+		{"TASM", "<1 !! 2>", "1 ! 2", ""},
+		{"TASM", "<'!>'>", "'!>'", ""},
+		{"TASM", "<!> '!a'>", "> '!a'", ""},
+		{"TASM", "<a b>", "a b", ""},
+		{"MASM", "<a !> b>", "a !", "extra characters on line:  b>"},
+	}
+	for _, test := range tests {
+		p, _ := parseString(t, "", ParseOptions{Syntax: test.syntax})
+		got, err := p.text(test.s)
+		checkErrors(t, err, ESWarning, test.err)
+		if got != test.want {
+			t.Errorf("%s: %s = %q, want %q", test.syntax, test.s, got, test.want)
+		}
+	}
+}
+
+func TestMacroDefaults(t *testing.T) {
+	tests := []struct {
+		def, call string
+		want      []byte
+	}{
+		{"x:=<1, 2>", "m", []byte{1, 2}},
+		{"x:=<1, 2>", "m 3", []byte{3}},
+		{"x:=<1, 2>", "m <4, 5>", []byte{4, 5}},
+		{"x:=3", "m", []byte{3}},
+		{"x:=<>", "m", nil},
+		{"x:=<'a&b'>", "m", []byte("a&b")},
+	}
+	for _, test := range tests {
+		src := "m macro " + test.def + "\n\tifnb <x>\n\tdb x\n\tendif\nendm\n" +
+			"d segment\n" + test.call + "\nd ends\n"
+		p, err := parseString(t, src, ParseOptions{})
+		checkErrors(t, err, ESWarning, "")
+		if got := segmentBytes(t, p, "d"); !bytes.Equal(got, test.want) {
+			t.Errorf("%s, %s: got % x, want % x", test.def, test.call, got, test.want)
+		}
+	}
+}
+
+func TestMacroConcatenation(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"mov ax, reg&x", "regfoo"},
+		{"mov ax, x&reg", "fooreg"},
+		{"mov ax, a&x&b", "afoob"},
+		{"mov ax, &x&", "foo"},
+		{"mov ax, a && x", "a && foo"},
+		{"mov ax, a&&x", "a&foo"},
+		{"mov ax, a&b", "a&b"},
+	}
+	for _, test := range tests {
+		src := "m macro x\n\t" + test.line + "\nendm\nc segment\nm foo\nc ends\n"
+		for _, syntax := range []string{"TASM", "MASM"} {
+			p, err := parseString(t, src, ParseOptions{Syntax: syntax})
+			checkErrors(t, err, ESWarning, "")
+			var buf bytes.Buffer
+			EmitAsm(&buf, Expanded(p.instructions), 0)
+			checkOutput(t, buf.String(), []string{"mov\tax, " + test.want + "\n"})
+		}
+	}
+}
+
+func TestMacroSegmentNames(t *testing.T) {
+	src := "mkseg macro name\n" +
+		"name&_TEXT segment\nname&_start proc\ndb 1\nret\nname&_start endp\nname&_TEXT ends\n" +
+		"endm\n"
+	tests := []struct {
+		call, seg, proc string
+		err             string
+	}{
+		{"mkseg foo", "foo_TEXT", "foo_start", ""},
+		{"mkseg _a", "_a_TEXT", "_a_start", ""},
+		{"mkseg 1", "", "", "invalid segment name: 1_TEXT"},
+	}
+	for _, test := range tests {
+		p, err := parseString(t, src+test.call+"\n", ParseOptions{})
+		checkErrors(t, err, ESWarning, test.err)
+		if test.seg == "" {
+			continue
+		}
+		if got := segmentBytes(t, p, test.seg); !bytes.Equal(got, []byte{1}) {
+			t.Errorf("%s: got % x, want 01", test.call, got)
+		}
+		if len(p.procs) != 1 || p.procs[0].name != test.proc {
+			t.Errorf("%s: got procedures %v", test.call, p.procs)
+		}
+	}
+}
+
+func TestNestedTextParams(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"<<a>,<b>>, c", []string{"<<a>,<b>>", "c"}},
+		{"<<<x>>>", []string{"<<<x>>>"}},
+		{"<a !> b>, c", []string{"<a !> b>", "c"}},
+		{"<a !, b>, c", []string{"<a !, b>", "c"}},
+		{"<'>', x>, y", []string{"<'>', x>", "y"}},
+	}
+	for _, test := range tests {
+		var got []string
+		stream := NewLexStream(nil, test.line)
+		for {
+			got = append(got, strings.TrimSpace(stream.nextParam(0)))
+			if stream.next() == eof {
+				break
+			}
+		}
+		if strings.Join(got, "|") != strings.Join(test.want, "|") {
+			t.Errorf("%s: got %q, want %q", test.line, got, test.want)
+		}
+	}
+
+	p, _ := parseString(t, "", ParseOptions{Syntax: "TASM"})
+	if got, err := p.text("<<<x>>>"); got != "<<x>>" || err != nil {
+		t.Errorf("<<<x>>>: got %q, %v", got, err)
+	}
+
+	src := "inner macro a, b\n\tdb a\n\tdb b\nendm\n" +
+		"outer macro args\n\tinner args\nendm\n" +
+		"d segment\nouter <<1, 2>, <3>>\nd ends\n"
+	p, err := parseString(t, src, ParseOptions{})
+	checkErrors(t, err, ESWarning, "")
+	if got := segmentBytes(t, p, "d"); !bytes.Equal(got, []byte{1, 2, 3}) {
+		t.Errorf("forwarded arguments: got % x, want 01 02 03", got)
+	}
+}
+
+func TestIFIDNTextMacros(t *testing.T) {
+	tests := []struct {
+		cond string
+		want []byte
+	}{
+		{"ifidni <%TXT>, <abc>", []byte{1}},
+		{"ifidn <%TXT>, <abc>", []byte{2}},
+		{"ifidn <%TXT>, <ABC>", []byte{1}},
+		{"ifdifi <%TXT>, <abc>", []byte{2}},
+		{"ifidn <%LST>, <a, b>", []byte{1}},
+		{"ifidn <%LST>, <%LST>", []byte{1}},
+		{"ifdif <%LST>, <a>", []byte{1}},
+		{"ifidn <'%TXT'>, <ABC>", []byte{2}},
+	}
+	for _, test := range tests {
+		src := "TXT equ <ABC>\nLST equ <a, b>\nd segment\n" +
+			test.cond + "\ndb 1\nelse\ndb 2\nendif\nd ends\n"
+		p, err := parseString(t, src, ParseOptions{})
+		checkErrors(t, err, ESWarning, "")
+		if got := segmentBytes(t, p, "d"); !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got % x, want % x", test.cond, got, test.want)
+		}
+	}
+}
+
+func TestIRPInMacros(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []byte
+	}{
+		{"m macro args\n\tirp x, <args>\n\tdb x\n\tendm\nendm\nm <1, 2, 3>\n", []byte{1, 2, 3}},
+		{"m macro a, b\n\tirp x, <a, b>\n\tdb x * 2\n\tendm\nendm\nm 1, 2\n", []byte{2, 4}},
+		{"m macro s\n\tirpc c, s\n\tdb c\n\tendm\nendm\nm 123\n", []byte{1, 2, 3}},
+		{"irp x, <1, 2>\nirp y, <3, 4>\ndb x * y\nendm\nendm\n", []byte{3, 4, 6, 8}},
+		{"m macro args\n\tirp x, <args>\n\tirp y, <x, 0>\n\tdb y\n\tendm\n\tendm\nendm\nm <5, 6>\n", []byte{5, 0, 6, 0}},
+	}
+	for _, test := range tests {
+		p, err := parseString(t, "d segment\n"+test.src+"d ends\n", ParseOptions{})
+		checkErrors(t, err, ESWarning, "")
+		if got := segmentBytes(t, p, "d"); !bytes.Equal(got, test.want) {
+			t.Errorf("%q: got % x, want % x", test.src, got, test.want)
+		}
+	}
+}
+
+func TestStringConditions(t *testing.T) {
+	tests := []struct {
+		cond string
+		want []byte
+	}{
+		{"if ('A' lt 'B')", []byte{1}},
+		{"ife ('A' eq 'A')", []byte{2}},
+		{"if ('A' eq 41h)", []byte{1}},
+		{"if 'b' - 'a' eq 1", []byte{1}},
+		{"if ('AB' gt 'AA')", []byte{1}},
+		{"if 0\nelseif ('A' ne 'A')", []byte{2}},
+		{"if 0\nelseif ('A' le 'A')", []byte{1}},
+	}
+	for _, test := range tests {
+		src := "d segment\n" + test.cond + "\ndb 1\nelse\ndb 2\nendif\nd ends\n"
+		p, err := parseString(t, src, ParseOptions{})
+		checkErrors(t, err, ESWarning, "")
+		if got := segmentBytes(t, p, "d"); !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got % x, want % x", test.cond, got, test.want)
+		}
+	}
+}
+
+func TestIFDEF(t *testing.T) {
+	tests := []struct {
+		cond string
+		want []byte
+	}{
+		{"ifdef foo", []byte{1}},
+		{"ifdef bar", []byte{2}},
+		{"ifndef bar", []byte{1}},
+		{"ifdef ax", []byte{1}},
+		{"ifdef EAX", []byte{1}},
+		{"ifndef ds", []byte{2}},
+		{"ifdef @CPU", []byte{1}},
+		{"ifdef @Model", []byte{1}},
+		{"ifdef dword", []byte{1}},
+		{"ifdef segment", []byte{1}},
+		{"ifdef bar\nelseifdef foo", []byte{1}},
+		{"ifdef bar\nelseifdef ax", []byte{1}},
+		{"ifdef bar\nelseifdef @CPU", []byte{1}},
+		{"ifdef bar\nelseifdef baz", []byte{2}},
+		{"if 0\nelseifndef bar", []byte{1}},
+	}
+	for _, test := range tests {
+		src := ".model small\nfoo = 1\nd segment\n" + test.cond + "\ndb 1\nelse\ndb 2\nendif\nd ends\n"
+		p, err := parseString(t, src, ParseOptions{})
+		checkErrors(t, err, ESWarning, "")
+		if got := segmentBytes(t, p, "d"); !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got % x, want % x", test.cond, got, test.want)
+		}
+	}
+}
+
+func TestINSTR(t *testing.T) {
+	tests := []struct {
+		params string
+		want   int64
+	}{
+		{"<abcabc>, <bc>", 2},
+		{"3, <abcabc>, <bc>", 5},
+		{"<abcabc>, <x>", 0},
+		{"6, <abcabc>, <bc>", 0},
+		{"7, <abcabc>, <bc>", 0},
+		{"7, <abcabc>, <>", 7},
+	}
+	for _, test := range tests {
+		p, err := parseString(t, "pos INSTR "+test.params+"\n", ParseOptions{})
+		checkErrors(t, err, ESWarning, "")
+		if got := symInt(t, p, "pos"); got != test.want {
+			t.Errorf("INSTR %s = %d, want %d", test.params, got, test.want)
+		}
+	}
+	_, err := parseString(t, "pos INSTR 8, <abcabc>, <bc>\n", ParseOptions{})
+	checkErrors(t, err, ESError, "INSTR start index out of range (1-7): 8")
+}
+
+func TestTextIndexBounds(t *testing.T) {
+	tests := []struct {
+		src  string
+		text string // Resulting text, if no error is expected
+		err  string // Expected error or warning
+	}{
+		{"s SUBSTR <abc>, 1", "abc", ""},
+		{"s SUBSTR <abc>, 2, 1", "b", ""},
+		{"s SUBSTR <abc>, 4", "", ""},
+		{"s SUBSTR <abc>, 4, 0", "", ""},
+		{"s SUBSTR <abc>, 0", "", "SUBSTR start index out of range (1-4): 0"},
+		{"s SUBSTR <abc>, 5", "", "SUBSTR start index out of range (1-4): 5"},
+		{"s SUBSTR <abc>, 1, -1", "", "SUBSTR length can't be negative: -1"},
+		{"s SUBSTR <abc>, 2, 5", "bc", "SUBSTR length runs past the end of the text, clamping to 2: 5"},
+		{"s INSTR 0, <abc>, <a>", "", "INSTR start index out of range (1-4): 0"},
+		{"s INSTR 5, <abc>, <a>", "", "INSTR start index out of range (1-4): 5"},
+	}
+	for _, test := range tests {
+		p, err := parseString(t, test.src+"\n", ParseOptions{})
+		if test.err == "" {
+			checkErrors(t, err, ESWarning, "")
+		} else if err.Severity() >= ESError {
+			checkErrors(t, err, ESError, test.err)
+			continue
+		} else {
+			checkErrors(t, err, ESWarning, test.err)
+		}
+		val, _ := p.syms.Get("s")
+		if text, ok := val.(asmText); !ok || string(text) != test.text {
+			t.Errorf("%s: got %#v, want %q", test.src, val, test.text)
+		}
+	}
+}
+
+func TestNestedMacroArguments(t *testing.T) {
+	tests := []struct {
+		args  string
+		first string
+		blank bool // Whether the second parameter is blank
+	}{
+		{"(a,b)", "(a,b)", true},
+		{"<x,y>", "x,y", true},
+		{"'a,b'", "'a,b'", true},
+		{"(1 lt 2, 3)", "(1 lt 2, 3)", true},
+		{"<'>', z>", "'>', z", true},
+		{"(a,b), c", "(a,b)", false},
+		{"<x,y>, c", "x,y", false},
+		{"a, b", "a", false},
+	}
+	src := "m macro p1, p2\n" +
+		"first SUBSTR <p1>, 1\n" +
+		"IFB <p2>\nblank = 1\nELSE\nblank = 0\nENDIF\n" +
+		"endm\n"
+	for _, test := range tests {
+		p, err := parseString(t, src+"m "+test.args+"\n", ParseOptions{})
+		checkErrors(t, err, ESWarning, "")
+		val, _ := p.syms.Get("first")
+		if text, ok := val.(asmText); !ok || string(text) != test.first {
+			t.Errorf("%s: first argument is %#v, want %q", test.args, val, test.first)
+		}
+		if got := symInt(t, p, "blank") != 0; got != test.blank {
+			t.Errorf("%s: IFB on second argument = %v, want %v", test.args, got, test.blank)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Procedure declarations.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// procVar is an argument or local variable of a procedure.
+type procVar struct {
+	name  string
+	unit  DataUnit
+	count uint // Number of elements; 1 for non-arrays
+}
+
+func (v procVar) String() string {
+	if v.count != 1 {
+		return fmt.Sprintf("%s[%d]:%s", v.name, v.count, v.unit.Name())
+	}
+	return v.name + ":" + v.unit.Name()
+}
+
+// asmProc describes a procedure together with the arguments, local
+// variables, and preserved registers declared for it.
+type asmProc struct {
+	name   string
+	args   []procVar
+	locals []procVar
+	uses   []string
+	// Number of instructions between PROC and ENDP, excluding the
+	// declarations above.
+	instructions int
+}
+
+// procModifiers lists the distances and language types that can come before
+// the argument list of a PROC directive.
+var procModifiers = map[string]bool{
+	"NEAR": true, "FAR": true, "NEAR16": true, "NEAR32": true,
+	"FAR16": true, "FAR32": true,
+	"C": true, "CPP": true, "PASCAL": true, "BASIC": true, "FORTRAN": true,
+	"PROLOG": true, "NOLANGUAGE": true, "STDCALL": true, "SYSCALL": true,
+	"WINDOWS": true, "ODDNEAR": true, "ODDFAR": true,
+	"PUBLIC": true, "PRIVATE": true, "EXPORT": true,
+}
+
+// procDeclaration reads the preserved registers and arguments from the
+// parameters of a PROC directive into p.procDecl.
+func (p *parser) procDeclaration(it *item) (err ErrorList) {
+	var args []string
+	for i, param := range it.params {
+		if i > 0 {
+			args = append(args, param)
+			continue
+		}
+		words := strings.Fields(param)
+		uses := false
+		for w, word := range words {
+			wordUpper := strings.ToUpper(word)
+			if strings.IndexByte(word, ':') != -1 {
+				args = append(args, strings.Join(words[w:], " "))
+				break
+			} else if wordUpper == "USES" {
+				uses = true
+			} else if uses {
+				p.procDecl.uses = append(p.procDecl.uses, word)
+			} else if !procModifiers[wordUpper] {
+				err = err.AddF(ESWarning,
+					"ignoring unknown procedure attribute: %s", word,
+				)
+			}
+		}
+	}
+	vars, errVars := p.procVars(it, args)
+	p.procDecl.args = append(p.procDecl.args, vars...)
+	return err.AddL(errVars)
+}
+
+// procVars parses the given argument or local variable declarations, of the
+// form name[count]:type:count, with both counts and the type being optional.
+// The last declaration can be followed by = and a symbol name, which is then
+// set to the total number of bytes of all variables.
+func (p *parser) procVars(it *item, decls []string) (ret []procVar, err ErrorList) {
+	var sizeSym string
+	var size uint
+	if last := len(decls) - 1; last >= 0 {
+		if i := strings.IndexByte(decls[last], '='); i != -1 {
+			sizeSym = strings.TrimSpace(decls[last][i+1:])
+			decls = append(decls[:last:last], decls[last][:i])
+		}
+	}
+	evalCount := func(expr string) (uint, ErrorList) {
+		count, err := p.syms.evalInt(it.pos, expr)
+		if err.Severity() >= ESError {
+			return 0, err
+		} else if count.n < 1 {
+			return 0, err.AddF(ESError, "invalid element count: %s", expr)
+		}
+		return uint(count.n), err
+	}
+	for _, decl := range decls {
+		name, typ := splitColon(decl)
+		v := procVar{name: name, count: 1}
+		if i := strings.IndexByte(name, '['); i != -1 && strings.HasSuffix(name, "]") {
+			count, errCount := evalCount(name[i+1 : len(name)-1])
+			if err = err.AddL(errCount); errCount.Severity() >= ESError {
+				continue
+			}
+			v.name = strings.TrimSpace(name[:i])
+			v.count = count
+		}
+		typ, countExpr := splitColon(typ)
+		if countExpr != "" {
+			count, errCount := evalCount(countExpr)
+			if err = err.AddL(errCount); errCount.Severity() >= ESError {
+				continue
+			}
+			v.count *= count
+		}
+		if v.name == "" {
+			err = err.AddF(ESError, "missing variable name: %s", decl)
+			continue
+		} else if typ == "" {
+			v.unit = SimpleData(p.intSyms.SegmentWordSize())
+		} else {
+			unit, errType := p.typeExprUnit(typ)
+			if err = err.AddL(errType); errType.Severity() >= ESError {
+				continue
+			}
+			v.unit = unit
+		}
+		size += v.unit.Width() * v.count
+		ret = append(ret, v)
+	}
+	if sizeSym != "" {
+		err = err.AddL(p.syms.Set(sizeSym, asmInt{n: int64(size)}, false))
+	}
+	return ret, err
+}
+
+func ARG(p *parser, it *item) ErrorList {
+	if p.proc.nest == 0 {
+		return ErrorListF(ESError, "%s outside of a procedure", it.val)
+	}
+	vars, err := p.procVars(it, it.params)
+	p.procDecl.args = append(p.procDecl.args, vars...)
+	return err
+}
+
+func LOCAL(p *parser, it *item) ErrorList {
+	if p.proc.nest == 0 {
+		return ErrorListF(ESError, "%s outside of a procedure", it.val)
+	}
+	vars, err := p.procVars(it, it.params)
+	p.procDecl.locals = append(p.procDecl.locals, vars...)
+	return err
+}
+
+func USES(p *parser, it *item) ErrorList {
+	if p.proc.nest == 0 {
+		return ErrorListF(ESError, "%s outside of a procedure", it.val)
+	}
+	for _, param := range it.params {
+		p.procDecl.uses = append(p.procDecl.uses, strings.Fields(param)...)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProcSegments(t *testing.T) {
+	tests := []struct {
+		src string
+		err string
+	}{
+		{"a segment\np proc\nret\np endp\na ends\n", ""},
+		{
+			"a segment\np proc\nret\na ends\nb segment\np endp\nb ends\n",
+			"procedure p opened in segment a, but closed in b",
+		},
+		{
+			"a segment\np proc\nb segment\nb ends\nret\np endp\na ends\n", "",
+		},
+	}
+	for _, test := range tests {
+		_, err := parseString(t, test.src, ParseOptions{})
+		checkErrors(t, err, ESWarning, test.err)
+	}
+}
+
+func TestProcArguments(t *testing.T) {
+	tests := []struct {
+		decl string
+		args []string
+		err  string
+	}{
+		{"p proc a:word, b:dword", []string{"a", "b"}, ""},
+		{"p proc near uses si di, a:word", []string{"a"}, ""},
+		{"p proc bogus a:word", []string{"a"}, "ignoring unknown procedure attribute: bogus"},
+		{"p proc bogus a:word, b:word", []string{"a", "b"}, "ignoring unknown procedure attribute: bogus"},
+	}
+	for _, test := range tests {
+		src := "c segment\n" + test.decl + "\nret\np endp\nc ends\n"
+		p, err := parseString(t, src, ParseOptions{Syntax: "TASM"})
+		checkErrors(t, err, ESWarning, test.err)
+		if len(p.procs) != 1 {
+			t.Fatalf("%s: got %d procedures", test.decl, len(p.procs))
+		}
+		var args []string
+		for _, arg := range p.procs[0].args {
+			args = append(args, arg.name)
+		}
+		if strings.Join(args, ", ") != strings.Join(test.args, ", ") {
+			t.Errorf("%s: got arguments %v, want %v", test.decl, args, test.args)
+		}
+	}
+}
+
+func TestLabeledTerminators(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string // Expected items for the last two lines
+		err  string
+	}{
+		{"myproc proc\nret\nmyproc endp\nc ends\n", "myproc\tENDP\nc\tENDS", ""},
+		{"myproc proc\nret\ndone: endp\nc ends\n", "done:\n\tENDP\nc\tENDS", ""},
+		{"myproc proc\nret\ndone: myproc endp\nc ends\n", "done:\nmyproc\tENDP\nc\tENDS", ""},
+		{"myproc proc\nret\nmyproc endp\nlast: c ends\n", "myproc\tENDP\nlast:\nc\tENDS", ""},
+		{
+			"myproc proc\nret\ndone: other endp\nc ends\n", "done:\nother\tENDP\nc\tENDS",
+			"ENDP name doesn't match open procedure myproc: other",
+		},
+	}
+	for _, test := range tests {
+		p, err := parseString(t, "c segment\n"+test.src, ParseOptions{})
+		checkErrors(t, err, ESWarning, test.err)
+		if len(p.procs) != 1 || p.procs[0].name != "myproc" {
+			t.Errorf("%q: got procedures %v", test.src, p.procs)
+		}
+		if len(p.segs) != 0 {
+			t.Errorf("%q: segment is still open", test.src)
+		}
+		var items []string
+		for _, it := range p.instructions[3:] {
+			items = append(items, it.String())
+		}
+		if got := strings.Join(items, "\n"); got != test.want {
+			t.Errorf("%q: got items\n%s\nwant\n%s", test.src, got, test.want)
+		}
+	}
+}
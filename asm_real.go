@@ -0,0 +1,171 @@
+// Assembly floating-point literal handling.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// asmReal represents a floating-point constant.
+type asmReal struct {
+	f        float64
+	raw      []byte // Little-endian encoding given with the R suffix, if any
+	wordsize uint8  // Number of bytes to be produced on Emit()
+}
+
+func (v asmReal) Thing() string {
+	return "real number"
+}
+
+func (v asmReal) String() string {
+	if v.raw != nil {
+		ret := make([]byte, len(v.raw))
+		for i, b := range v.raw {
+			ret[len(v.raw)-1-i] = b
+		}
+		return strings.ToUpper(hex.EncodeToString(ret)) + "r"
+	}
+	ret := strconv.FormatFloat(v.f, 'g', -1, 64)
+	if strings.IndexAny(ret, ".eIN") == -1 {
+		ret += ".0"
+	}
+	return ret
+}
+
+// Neg returns the negation of v.
+func (v asmReal) Neg() asmReal {
+	if v.raw != nil {
+		raw := append([]byte{}, v.raw...)
+		raw[len(raw)-1] ^= 0x80
+		v.raw = raw
+	} else {
+		v.f = -v.f
+	}
+	return v
+}
+
+// checkWidth returns an error if v can't be emitted with its word size.
+func (v asmReal) checkWidth() ErrorList {
+	if v.raw != nil && len(v.raw) != int(v.wordsize) {
+		return ErrorListF(ESError,
+			"encoded real number has %d bytes, but the data width is %d: %s",
+			len(v.raw), v.wordsize, v,
+		)
+	}
+	switch v.wordsize {
+	case 4:
+		if v.raw == nil && !math.IsInf(v.f, 0) &&
+			math.IsInf(float64(float32(v.f)), 0) {
+			return ErrorListF(ESError,
+				"real number too large for %d bytes: %s", v.wordsize, v,
+			)
+		}
+		return nil
+	case 8, 10:
+		return nil
+	}
+	return ErrorListF(ESError,
+		"real numbers require a data width of 4, 8, or 10 bytes, not %d: %s",
+		v.wordsize, v,
+	)
+}
+
+// extended returns the little-endian 80-bit x87 extended precision encoding
+// of f. Since literals are parsed as float64, this can't be more precise
+// than that.
+func extended(f float64) []byte {
+	bits := math.Float64bits(f)
+	sign := uint16(bits>>63) << 15
+	exp := int((bits >> 52) & 0x7FF)
+	mant := bits & (1<<52 - 1)
+	var exp80 uint16
+	var mant80 uint64
+	switch {
+	case exp == 0x7FF: // Infinity and NaN
+		exp80 = 0x7FFF
+		mant80 = 1<<63 | mant<<11
+	case exp == 0 && mant == 0: // Zero
+	case exp == 0: // Denormals are normal numbers in 80-bit precision
+		exp = 1
+		for mant&(1<<52) == 0 {
+			mant <<= 1
+			exp--
+		}
+		exp80 = uint16(exp - 1023 + 16383)
+		mant80 = mant << 11
+	default:
+		exp80 = uint16(exp - 1023 + 16383)
+		mant80 = (1<<52 | mant) << 11
+	}
+	ret := make([]byte, 10)
+	binary.LittleEndian.PutUint64(ret, mant80)
+	binary.LittleEndian.PutUint16(ret[8:], sign|exp80)
+	return ret
+}
+
+func (v asmReal) Emit() []byte {
+	if v.raw != nil {
+		return v.raw
+	}
+	ret := make([]byte, v.wordsize)
+	switch v.wordsize {
+	case 4:
+		binary.LittleEndian.PutUint32(ret, math.Float32bits(float32(v.f)))
+	case 8:
+		binary.LittleEndian.PutUint64(ret, math.Float64bits(v.f))
+	case 10:
+		return extended(v.f)
+	}
+	return ret
+}
+
+func (v asmReal) Len() uint {
+	return uint(v.wordsize)
+}
+
+// isAsmReal checks whether input is to be interpreted as a single
+// floating-point constant, either in decimal notation with a decimal point,
+// or as its hexadecimal encoding followed by an R.
+func isAsmReal(input string) bool {
+	if len(input) < 2 || input[0] < '0' || input[0] > '9' {
+		return false
+	}
+	last := len(input) - 1
+	if input[last] == 'r' || input[last] == 'R' {
+		return strings.Trim(input[:last], "0123456789abcdefABCDEF") == ""
+	}
+	return strings.IndexByte(input, '.') != -1 &&
+		strings.Trim(input, "0123456789.eE+-") == ""
+}
+
+// newAsmReal parses the input as a floating-point constant.
+func newAsmReal(input string) (asmReal, ErrorList) {
+	last := len(input) - 1
+	if input[last] == 'r' || input[last] == 'R' {
+		digits := input[:last]
+		// A leading zero is necessary if the encoding starts with a letter.
+		if len(digits)%2 != 0 && digits[0] == '0' {
+			digits = digits[1:]
+		}
+		encoded, err := hex.DecodeString(digits)
+		if err != nil {
+			return asmReal{}, ErrorListF(ESError,
+				"invalid encoded real number: %s", input,
+			)
+		}
+		raw := make([]byte, len(encoded))
+		for i, b := range encoded {
+			raw[len(encoded)-1-i] = b
+		}
+		return asmReal{raw: raw}, nil
+	}
+	f, err := strconv.ParseFloat(input, 64)
+	if err != nil {
+		return asmReal{}, ErrorListF(ESError, "invalid real number: %s", input)
+	}
+	return asmReal{f: f}, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRealData(t *testing.T) {
+	tests := []struct {
+		decl string
+		want []byte
+		err  string
+	}{
+		{"dd 1.0", []byte{0x00, 0x00, 0x80, 0x3f}, ""},
+		{"real4 -2.5", []byte{0x00, 0x00, 0x20, 0xc0}, ""},
+		{"dd 1.0, 2.0", []byte{0x00, 0x00, 0x80, 0x3f, 0x00, 0x00, 0x00, 0x40}, ""},
+		{"dq 1.0", []byte{0, 0, 0, 0, 0, 0, 0xf0, 0x3f}, ""},
+		{"real8 0.5", []byte{0, 0, 0, 0, 0, 0, 0xe0, 0x3f}, ""},
+		{"dt 1.0", []byte{0, 0, 0, 0, 0, 0, 0, 0x80, 0xff, 0x3f}, ""},
+		{"real10 -3.0", []byte{0, 0, 0, 0, 0, 0, 0, 0xc0, 0x00, 0xc0}, ""},
+		{"real10 0.0", make([]byte, 10), ""},
+		{"dd 3F800000r", []byte{0x00, 0x00, 0x80, 0x3f}, ""},
+		{"dd 1.0e39", nil, "real number too large for 4 bytes"},
+		{"dw 1.0", nil, "real numbers require a data width of 4, 8, or 10 bytes"},
+		{"dq 3F800000r", nil, "encoded real number has 4 bytes"},
+	}
+	for _, test := range tests {
+		p, err := parseString(t, "d segment\n"+test.decl+"\nd ends\n", ParseOptions{})
+		checkErrors(t, err, ESError, test.err)
+		if got := segmentBytes(t, p, "d"); test.err == "" && !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got % x, want % x", test.decl, got, test.want)
+		}
+	}
+}
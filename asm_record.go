@@ -0,0 +1,151 @@
+// Parsing of assembly records.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// asmRecordField represents a bit field of a record. In arithmetic
+// expressions, it evaluates to its shift count.
+type asmRecordField struct {
+	record string
+	name   string
+	shift  uint
+	width  uint
+	init   int64
+}
+
+func (v asmRecordField) Thing() string {
+	return "record field"
+}
+
+func (v asmRecordField) String() string {
+	return fmt.Sprintf(
+		"field of %s (%d bits, shifted by %d)", v.record, v.width, v.shift,
+	)
+}
+
+// Mask returns the bit mask of v within its record.
+func (v asmRecordField) Mask() int64 {
+	return ((1 << v.width) - 1) << v.shift
+}
+
+type asmRecord struct {
+	name   string
+	fields []asmRecordField // From the most to the least significant one
+}
+
+func (v asmRecord) Thing() string {
+	return "record"
+}
+
+func (v asmRecord) String() string {
+	var fields []string
+	for _, field := range v.fields {
+		fields = append(fields, fmt.Sprintf("%s:%d", field.name, field.width))
+	}
+	return fmt.Sprintf(
+		"RECORD (%d bits) [%s]", v.Width(), strings.Join(fields, ", "),
+	)
+}
+
+// Width returns the number of bits in v.
+func (v asmRecord) Width() (ret uint) {
+	for _, field := range v.fields {
+		ret += field.width
+	}
+	return ret
+}
+
+// Mask returns the bit mask covering all fields of v.
+func (v asmRecord) Mask() (ret int64) {
+	for _, field := range v.fields {
+		ret |= field.Mask()
+	}
+	return ret
+}
+
+// recordField returns the field with the given name in the record with the
+// given name, if there is one.
+func (s *SymMap) recordField(record, name string) (asmVal, ErrorList) {
+	val, err := s.Lookup(record)
+	switch val.(type) {
+	case asmRecord:
+		for _, field := range val.(asmRecord).fields {
+			if s.Equal(field.name, name) {
+				return field, err
+			}
+		}
+	}
+	return nil, err
+}
+
+func RECORD(p *parser, it *item) (err ErrorList) {
+	maxBits := uint(p.intSyms.WordSize) * 8
+	record := asmRecord{name: it.sym}
+	for _, param := range it.params {
+		name, widthExpr := splitColon(param)
+		var initExpr string
+		if i := strings.IndexByte(widthExpr, '='); i != -1 {
+			widthExpr, initExpr = widthExpr[:i], widthExpr[i+1:]
+		}
+		if name == "" || widthExpr == "" {
+			return err.AddF(ESError,
+				"record fields must be given as name:width[=initial value]: %s",
+				param,
+			)
+		}
+		width, errWidth := p.syms.evalInt(it.pos, widthExpr)
+		if err = err.AddL(errWidth); errWidth.Severity() >= ESError {
+			return err
+		} else if width.n < 1 || width.n > int64(maxBits) {
+			return err.AddF(ESError,
+				"width of record field out of range (1-%d): %s", maxBits, name,
+			)
+		}
+		field := asmRecordField{
+			record: it.sym, name: name, width: uint(width.n),
+		}
+		if initExpr != "" {
+			init, errInit := p.syms.evalInt(it.pos, initExpr)
+			if err = err.AddL(errInit); errInit.Severity() >= ESError {
+				return err
+			} else if init.n < 0 || init.n >= (1<<field.width) {
+				err = err.AddF(ESWarning,
+					"initial value of record field doesn't fit into %d bits: %s",
+					field.width, name,
+				)
+			}
+			field.init = init.n
+		}
+		record.fields = append(record.fields, field)
+	}
+	if bits := record.Width(); bits > maxBits {
+		return err.AddF(ESError,
+			"record exceeds %d bits: %d", maxBits, bits,
+		)
+	}
+	shift := record.Width()
+	for i := range record.fields {
+		shift -= record.fields[i].width
+		record.fields[i].shift = shift
+	}
+	for _, field := range record.fields {
+		existing, _ := p.syms.Lookup(field.name)
+		switch existing.(type) {
+		case asmRecordField:
+			other := existing.(asmRecordField).record
+			if !p.syms.Equal(other, it.sym) {
+				err = err.AddF(ESError,
+					"record field name is ambiguous, already defined in %s: %s",
+					other, field.name,
+				)
+				continue
+			}
+		}
+		err = err.AddL(p.syms.Set(field.name, field, true))
+	}
+	return err.AddL(p.syms.Set(it.sym, record, true))
+}
@@ -54,6 +54,21 @@ func (v asmInt) formatASCII() string {
 	return strings.TrimLeft(string(ret), "\x00")
 }
 
+// isASCII returns whether v can be represented as a string literal of
+// printable ASCII characters.
+func (v asmInt) isASCII() bool {
+	if v.n <= 0 {
+		return false
+	}
+	str := v.formatASCII()
+	for i := 0; i < len(str); i++ {
+		if str[i] < 0x20 || str[i] >= 0x7F {
+			return false
+		}
+	}
+	return true
+}
+
 func quoteASCII(str string) string {
 	// Yes, since there is no escaping in assembly string literals,
 	// it's impossible to have both.
@@ -4,6 +4,7 @@ package main
 
 import (
 	"fmt"
+	"strings"
 )
 
 // strucFlag denotes whether a nesting level is a structure or union.
@@ -85,12 +86,176 @@ func (v *asmStruc) Offset() (chunk uint, off uint64) {
 }
 
 func (v *asmStruc) AddPointer(p *parser, sym string, ptr asmDataPtr) (err ErrorList) {
-	if len(p.strucs) == 1 && p.syntax == "TASM" {
+	// In Ideal mode, member names are local to their structure and can
+	// only be accessed using the dot operator.
+	if len(p.strucs) == 1 && p.syntax == "TASM" && !p.ideal {
 		err = p.syms.Set(sym, ptr, true)
 	}
 	return err.AddL(v.members.Set(sym, ptr, true))
 }
 
+// memberPath resolves the given dot-separated member path within v, whose
+// instance or type has the given name, and returns the offset of the last
+// member in the path relative to the start of v, together with its pointer.
+func (v *asmStruc) memberPath(base, path string) (off uint64, member asmDataPtr, err ErrorList) {
+	struc := v
+	prev := base
+	for _, name := range strings.Split(path, ".") {
+		if name == "" {
+			return 0, member, err.AddF(ESError,
+				"missing member name after %s", prev,
+			)
+		} else if struc == nil {
+			return 0, member, err.AddF(ESError,
+				"can't access member %s of non-structure member %s", name, prev,
+			)
+		}
+		memberVal, errMember := struc.members.Lookup(name)
+		err = err.AddL(errMember)
+		switch memberVal.(type) {
+		case asmDataPtr:
+			member = memberVal.(asmDataPtr)
+		default:
+			return 0, member, err.AddF(ESError,
+				"%s has no member named %s", struc.Name(), name,
+			)
+		}
+		off += member.off
+		struc, _ = member.ptr.unit.(*asmStruc)
+		prev = name
+	}
+	return off, member, err
+}
+
+// idealMembers replaces every member access of the form
+// (TYPE PTR operand).member in the instruction operand s with
+// operand+offset, where offset is the offset of member within the structure
+// TYPE. TASM's Ideal mode requires this form to access members through
+// registers.
+func (p *parser) idealMembers(s string) (ret string, err ErrorList) {
+	for {
+		end := strings.Index(s, ").")
+		if end == -1 {
+			return ret + s, err
+		}
+		start, depth := end-1, 0
+		for ; start >= 0 && (s[start] != '(' || depth > 0); start-- {
+			if s[start] == ')' {
+				depth++
+			} else if s[start] == '(' {
+				depth--
+			}
+		}
+		pathEnd := end + 2
+		for pathEnd < len(s) && (isSymbolChar(s[pathEnd]) || s[pathEnd] == '.') {
+			pathEnd++
+		}
+		inner := s[start+1 : end]
+		ptr := strings.Index(strings.ToUpper(inner), " PTR ")
+		if start < 0 || ptr == -1 {
+			ret += s[:pathEnd]
+			s = s[pathEnd:]
+			continue
+		}
+		typ := strings.TrimSpace(inner[:ptr])
+		operand := strings.TrimSpace(inner[ptr+len(" PTR "):])
+		val, errType := p.syms.Lookup(typ)
+		err = err.AddL(errType)
+		struc, ok := val.(asmStruc)
+		if !ok {
+			err = err.AddF(ESError,
+				"can't access member %s of non-structure %s", s[end+2:pathEnd], typ,
+			)
+			ret += s[:pathEnd]
+			s = s[pathEnd:]
+			continue
+		}
+		off, _, errPath := struc.memberPath(typ, s[end+2:pathEnd])
+		if err = err.AddL(errPath); errPath.Severity() >= ESError {
+			ret += s[:pathEnd]
+		} else {
+			ret += s[:start] + fmt.Sprintf("%s+%d", operand, off)
+		}
+		s = s[pathEnd:]
+	}
+}
+
+// memberAccess resolves the member path following a dot operator that comes
+// after an arbitrary address expression. If the type of the expression isn't
+// known, the first member is looked up among the global structure member
+// names, as done by MASM.
+func (s *SymMap) memberAccess(struc *asmStruc, path string) (uint64, asmDataPtr, ErrorList) {
+	if struc != nil {
+		return struc.memberPath("expression", path)
+	}
+	name, rest := path, ""
+	if i := strings.IndexByte(path, '.'); i != -1 {
+		name, rest = path[:i], path[i+1:]
+	}
+	val, err := s.Lookup(name)
+	switch val.(type) {
+	case asmDataPtr:
+		member := val.(asmDataPtr)
+		if _, ok := member.et.(*asmStruc); ok {
+			if rest == "" {
+				return member.off, member, err
+			}
+			inner, _ := member.ptr.unit.(*asmStruc)
+			off, last, errPath := inner.memberPath(name, rest)
+			return member.off + off, last, err.AddL(errPath)
+		}
+	}
+	return 0, asmDataPtr{}, err.AddF(ESError,
+		"not a structure member: %s", name,
+	)
+}
+
+// structMember resolves the given dot-separated member path within the
+// structure type or structure instance with the given name. Members of
+// structure types evaluate to their offset, members of instances to a data
+// pointer to the member.
+func (s *SymMap) structMember(base, path string) (asmVal, ErrorList) {
+	val, err := s.Lookup(base)
+	var struc *asmStruc
+	var instance *asmDataPtr
+	switch val.(type) {
+	case asmStruc:
+		v := val.(asmStruc)
+		struc = &v
+	case asmDataPtr:
+		v := val.(asmDataPtr)
+		switch v.ptr.unit.(type) {
+		case *asmStruc:
+			struc = v.ptr.unit.(*asmStruc)
+			instance = &v
+		}
+	}
+	if struc == nil {
+		if val != nil {
+			name := path
+			if i := strings.IndexByte(path, '.'); i != -1 {
+				name = path[:i]
+			}
+			err = err.AddF(ESError,
+				"can't access member %s of non-structure %s", name, base,
+			)
+		}
+		return nil, err
+	}
+	off, member, errPath := struc.memberPath(base, path)
+	if err = err.AddL(errPath); errPath.Severity() >= ESError {
+		return nil, err
+	}
+	if instance == nil {
+		return asmInt{n: int64(off)}, err
+	}
+	ret := *instance
+	ret.ptr = member.ptr
+	ret.off += off
+	ret.member = &member
+	return ret, err
+}
+
 func (v asmStruc) WordSize() uint8 {
 	ret := uint8(0)
 	for w := v.Width(); w > 0; w >>= 8 {
@@ -113,7 +278,7 @@ func STRUC(p *parser, it *item) (err ErrorList) {
 		} else if len(it.params) > 0 {
 			sym = it.params[0]
 		}
-	} else if err := it.missingRequiredSym(); err != nil {
+	} else if err := it.missingRequiredSym(); err.Severity() >= ESError {
 		return err
 	}
 	struc := &asmStruc{
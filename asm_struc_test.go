@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestIdealMemberAccess(t *testing.T) {
+	src := "ideal\nstruc S\na db ?\nc dw ?\nends S\n" +
+		"segment d\npad db 4 dup (?)\nw dw 0\nx = (S PTR w).c\nends d\n" +
+		"segment c\nmov ax, [(S PTR bx).c]\nmov al, [(S PTR si).a]\n" +
+		"mov ax, [(S PTR di + 2).c]\nmov ax, [bx]\nends c\n"
+	p, err := parseString(t, src, ParseOptions{Syntax: "TASM"})
+	checkErrors(t, err, ESWarning, "")
+	if got := symInt(t, p, "x"); got != 5 {
+		t.Errorf("x = %d, want 5", got)
+	}
+	var buf bytes.Buffer
+	EmitAsm(&buf, Expanded(p.instructions), 0)
+	checkOutput(t, buf.String(), []string{
+		"mov\tax, [bx+1]", "mov\tal, [si+0]", "mov\tax, [di + 2+1]", "mov\tax, [bx]",
+	})
+
+	for _, test := range []struct {
+		operand string
+		err     string
+	}{
+		{"[(S PTR bx).b]", "S has no member named b"},
+		{"[(w PTR bx).c]", "non-structure w"},
+	} {
+		src := strings.Replace(src, "[bx]", test.operand, 1)
+		_, err := parseString(t, src, ParseOptions{Syntax: "TASM"})
+		checkErrors(t, err, ESError, test.err)
+	}
+}
+
+func TestDotOperator(t *testing.T) {
+	base := "I STRUC\nx DW ?\nI ENDS\n" +
+		"S STRUC\na DB ?\nc DW ?\nin I <>\nS ENDS\n" +
+		"d segment\npad db 2 dup (?)\nv S <>\nw dw ?\nd ends\n"
+	tests := []struct {
+		expr string
+		want int64
+		err  string
+	}{
+		{"S.c", 1, ""},
+		{"S.in.x", 3, ""},
+		{"v.c", 3, ""},
+		{"v.in.x", 5, ""},
+		{"type v.c", 2, ""},
+		{"v[1].c", 4, ""},
+		{"S.zz", 0, "S has no member named zz"},
+		{"v.zz", 0, "S has no member named zz"},
+		{"w.c", 0, "can't access member c of non-structure w"},
+		{"S.c.x", 0, "can't access member x of non-structure member c"},
+		{"S.", 0, "missing member name after S"},
+		{"q.c", 0, "unknown symbol: Q"},
+	}
+	for _, test := range tests {
+		p, err := parseString(t, base+"r = "+test.expr+"\n", ParseOptions{})
+		checkErrors(t, err, ESError, test.err)
+		if test.err == "" {
+			if got := symInt(t, p, "r"); got != test.want {
+				t.Errorf("%s = %d, want %d", test.expr, got, test.want)
+			}
+		}
+	}
+}
+
+func TestPointerMembers(t *testing.T) {
+	tests := []struct {
+		model    string
+		size, of int64
+	}{
+		{"small", 10, 8},
+		{"medium", 10, 8},
+		{"compact", 12, 10},
+		{"large", 12, 10},
+	}
+	for _, test := range tests {
+		src := ".model " + test.model + "\n" +
+			"NPTR typedef near ptr\nFPTR typedef far ptr\nDPTR typedef ptr\n" +
+			".data\nNODE struc\nnext DPTR ?\nprev NPTR ?\nlink FPTR ?\nval dw ?\nNODE ends\n" +
+			"n NODE <>\ns = sizeof NODE\no = NODE.val\nl = size n.link\nend\n"
+		p, err := parseString(t, src, ParseOptions{})
+		checkErrors(t, err, ESWarning, "")
+		for name, want := range map[string]int64{"s": test.size, "o": test.of, "l": 4} {
+			if got := symInt(t, p, name); got != want {
+				t.Errorf("%s model: %s = %d, want %d", test.model, name, got, want)
+			}
+		}
+	}
+}
+
+func TestENDMInStructures(t *testing.T) {
+	tests := []struct {
+		src string
+		err string
+	}{
+		{"S struc\na db ?\nendm\n", "structure S must be closed with ENDS, not ENDM"},
+		{"endm\n", "unmatched ENDM"},
+		{"m macro\ndb 1\nendm\nS struc\na db ?\nS ends\n", ""},
+		{"m macro\ndb 1\nx endm\n", "ignoring name on ENDM: x"},
+	}
+	for _, test := range tests {
+		_, err := parseString(t, test.src, ParseOptions{})
+		checkErrors(t, err, ESWarning, test.err)
+	}
+
+	// ENDS still closes the structure after a stray ENDM.
+	p, _ := parseString(t, "S struc\na db ?\nendm\nb dw ?\nS ends\nsz = size S\n", ParseOptions{})
+	if got := symInt(t, p, "sz"); got != 3 {
+		t.Errorf("size S = %d, want 3", got)
+	}
+}
+
+func TestStructENDS(t *testing.T) {
+	tests := []struct {
+		syntax string
+		src    string
+		err    string
+	}{
+		{"MASM", "S struc\na db ?\nb dw ?\nS ends\n", ""},
+		{"MASM", "d segment\nS struc\na db ?\nb dw ?\nS ends\nd ends\n", ""},
+		{"MASM", "S struc\na db ?\nb dw ?\nends\n", "ENDS of top-level structure requires its name: S"},
+		{"MASM", "S struc\na db ?\nb dw ?\nT ends\n", "unmatched ENDS: T"},
+		{"TASM", "S struc\na db ?\nb dw ?\nS ends\n", ""},
+		{"TASM", "S struc\na db ?\nb dw ?\nends\n", ""},
+		{"TASM", "d segment\nS struc\na db ?\nb dw ?\nends\nends\n", ""},
+	}
+	for _, test := range tests {
+		p, err := parseString(t, test.src, ParseOptions{Syntax: test.syntax})
+		if test.err != "" {
+			checkErrors(t, err, ESError, test.err)
+			continue
+		}
+		checkErrors(t, err, ESWarning, "")
+		if _, ok := p.syms.Map["S"].Val.(asmStruc); !ok {
+			t.Errorf("%s: S is not a structure: %v", test.syntax, p.syms.Map["S"].Val)
+		}
+		if len(p.strucs) != 0 || len(p.segs) != 0 {
+			t.Errorf("%s: %q leaves blocks open", test.syntax, test.src)
+		}
+	}
+}
+
+func TestStructArrays(t *testing.T) {
+	src := "P STRUC\nx DB 1\ny DB 2\nz DW 3 DUP (?)\nP ENDS\n" +
+		"d segment\narr P 10 DUP (<>)\nd ends\n" +
+		"l = lengthof arr\ns = sizeof arr\nw = size P\n" +
+		"lz = lengthof arr.z\nsz = sizeof arr.z\n"
+	p, err := parseString(t, src, ParseOptions{})
+	checkErrors(t, err, ESWarning, "")
+	for name, want := range map[string]int64{
+		"l": 10, "s": 10 * 8, "w": 8, "lz": 3, "sz": 6,
+	} {
+		if got := symInt(t, p, name); got != want {
+			t.Errorf("%s = %d, want %d", name, got, want)
+		}
+	}
+	data := segmentBytes(t, p, "d")
+	if len(data) != 10*8 {
+		t.Fatalf("emitted %d bytes, want %d", len(data), 10*8)
+	}
+	want := []byte{1, 2, 0, 0, 0, 0, 0, 0}
+	for i := 0; i < 10; i++ {
+		if got := data[i*8 : (i+1)*8]; !bytes.Equal(got, want) {
+			t.Errorf("element %d: got % x, want % x", i, got, want)
+		}
+	}
+}
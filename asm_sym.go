@@ -11,13 +11,17 @@ import (
 
 type Symbol struct {
 	Constant bool // Constness of the stored value.
+	Public   bool // Exported to other modules via PUBLIC?
 	Val      asmVal
 }
 
 func (s Symbol) String() string {
 	var ret string
+	if s.Public {
+		ret = "(public) "
+	}
 	if s.Constant {
-		ret = "(const) "
+		ret += "(const) "
 	}
 	return ret + s.Val.String() + "\n"
 }
@@ -42,6 +46,19 @@ const (
 	TCHuge  = Flat | Huge
 )
 
+// Values of the @Interface symbol for the language set via .MODEL.
+const (
+	LangNone uint8 = iota
+	LangC
+	LangSyscall
+	LangStdcall
+	LangPascal
+	LangFortran
+	LangBasic
+	LangProlog // MASM's FASTCALL, TASM's PROLOG
+	LangCPP
+)
+
 // InternalSyms contains all internal symbols that can't be overwritten
 // through the normal symbol map. Pointer values are undefined at first.
 type InternalSyms struct {
@@ -59,6 +76,8 @@ type InternalSyms struct {
 	SymModel    *uint8
 	SymCodeSize *uint8
 	SymDataSize *uint8
+	// Returns the value of the $ location counter.
+	Location func() asmVal
 }
 
 // Lookup maps the members of s to their symbol names and returns their values
@@ -97,6 +116,11 @@ func (s *InternalSyms) Lookup(name string) (asmVal, bool) {
 		return *s.StackGroup, true
 	case "@WordSize", "@WORDSIZE":
 		return asmInt{n: int64(s.WordSize)}, true
+	case "$":
+		if s.Location == nil {
+			return nil, true
+		}
+		return s.Location(), true
 	}
 	if num == nil {
 		return nil, false
@@ -116,28 +140,79 @@ func (s InternalSyms) SegmentWordSize() uint8 {
 	return s.WordSize
 }
 
+// PtrWidth returns the size of a pointer with the given distance in a segment
+// with the given word size, or 0 if distance is not a valid one. Besides the
+// explicit NEAR and FAR, PROC and CODEPTR default to the code distance of the
+// memory model, and DATAPTR to its data distance.
+func (s InternalSyms) PtrWidth(distance string, wordsize uint8) uint {
+	far := false
+	switch distance {
+	case "NEAR":
+	case "FAR":
+		far = true
+	case "PROC", "CODEPTR":
+		far = s.SymCodeSize != nil && *s.SymCodeSize != 0
+	case "DATAPTR":
+		far = s.SymDataSize != nil && *s.SymDataSize != 0
+	default:
+		return 0
+	}
+	if far {
+		return uint(wordsize) + 2
+	}
+	return uint(wordsize)
+}
+
+// Decorate returns name as it appears in the object file, according to the
+// naming convention of the language set via .MODEL.
+func (s InternalSyms) Decorate(name string) string {
+	if s.Interface == nil {
+		return name
+	}
+	switch *s.Interface {
+	case LangC, LangStdcall:
+		return "_" + name
+	case LangPascal, LangFortran, LangBasic:
+		return strings.ToUpper(name)
+	}
+	// SYSCALL doesn't decorate at all. MASM's FASTCALL and STDCALL add the
+	// size of the procedure's parameters, TASM's CPP mangles the names
+	// with their types; neither is known at this point.
+	return name
+}
+
 type SymMap struct {
 	Map           map[string]Symbol
 	Internals     *InternalSyms
 	CaseSensitive *bool
+	// Names declared as PUBLIC before being defined, together with the
+	// position of their declaration.
+	publics map[string]ItemPos
 }
 
-// Dump returns a string listing all symbols in s in alphabetical order,
-// together with their values, indented with the given number of tabs.
-func (s SymMap) Dump(indent int) (ret string) {
-	if len(s.Map) == 0 {
-		return ""
-	}
+// Each calls fn for every symbol in s, in alphabetical order of their names.
+func (s *SymMap) Each(fn func(name string, sym Symbol)) {
 	var keys []string
 	for i := range s.Map {
 		keys = append(keys, i)
 	}
 	sort.Strings(keys)
 	for _, k := range keys {
+		fn(k, s.Map[k])
+	}
+}
+
+// Dump returns a string listing all symbols in s in alphabetical order,
+// together with their values, indented with the given number of tabs.
+func (s SymMap) Dump(indent int) (ret string) {
+	if len(s.Map) == 0 {
+		return ""
+	}
+	s.Each(func(name string, sym Symbol) {
 		ret += fmt.Sprintf(
-			"%s• %s: %s", strings.Repeat("\t", indent), k, s.Map[k],
+			"%s• %s: %s", strings.Repeat("\t", indent), name, sym,
 		)
-	}
+	})
 	return ret[:len(ret)-1]
 }
 
@@ -188,13 +263,18 @@ func (s *SymMap) Lookup(name string) (asmVal, ErrorList) {
 func (s *SymMap) Get(name string) (asmVal, ErrorList) {
 	if ret, err := s.Lookup(name); ret != nil {
 		return ret, err
+	} else if name == "$" {
+		return nil, ErrorListF(ESError,
+			"the location counter ($) is only defined inside a segment or structure",
+		)
 	}
-	return nil, ErrorListF(ESError, "unknown symbol: %s", name)
+	return nil, ErrorListUnresolved(s.ToSymCase(name))
 }
 
 // Set tries to add a new symbol with the given name and value to s, while
 // taking the constness of a possible existing value with the same name into
-// account. If name is empty, the function does nothing.
+// account. Constants can only be redefined to an identical value. If name is
+// empty, the function does nothing.
 func (s *SymMap) Set(name string, val asmVal, constant bool) ErrorList {
 	if name == "" {
 		return nil
@@ -206,18 +286,41 @@ func (s *SymMap) Set(name string, val asmVal, constant bool) ErrorList {
 			switch a.(type) {
 			case asmInt:
 				a, b := a.(asmInt), b.(asmInt)
+				// Same kludge as for pointers below: pass 2 may move the
+				// address a value was derived from, but it has to stay the
+				// same address.
+				sameTarget := (a.reloc == nil) == (b.reloc == nil) &&
+					(a.reloc == nil || a.reloc.target == b.reloc.target)
+				if a.addr && b.addr && sameTarget {
+					return true
+				}
 				return a.n == b.n && a.ptr == b.ptr
 			case asmDataPtr:
 				a, b := a.(asmDataPtr), b.(asmDataPtr)
-				// TODO: Temporary kludge to keep pointers working while we're
-				// migrating to a smarter pass system.
-				if a.off == 0 {
+				if a.external || b.external {
+					return a.external == b.external &&
+						a.ptr.unit.Width() == b.ptr.unit.Width()
+				}
+				// Pass 2 moves pointers whose offsets were only estimated.
+				if a.pass1 {
 					return true
 				}
 				return a.et.Name() == b.et.Name() &&
 					a.chunk == b.chunk &&
 					a.off == b.off &&
 					a.ptr.unit.Width() == b.ptr.unit.Width()
+			case asmRecordField:
+				return a.(asmRecordField) == b.(asmRecordField)
+			case asmTypedef:
+				a, b := a.(asmTypedef), b.(asmTypedef)
+				return a.unit.Width() == b.unit.Width()
+			case asmRecord:
+				a, b := a.(asmRecord), b.(asmRecord)
+				ret := a.name == b.name && len(a.fields) == len(b.fields)
+				for i := 0; ret && i < len(a.fields); i++ {
+					ret = a.fields[i] == b.fields[i]
+				}
+				return ret
 			}
 			return false
 		}
@@ -242,7 +345,11 @@ func (s *SymMap) Set(name string, val asmVal, constant bool) ErrorList {
 	}
 
 	realName := s.ToSymCase(name)
-	if _, ok := s.Internals.Lookup(realName); ok {
+	if realName == "$" {
+		return ErrorListF(ESError,
+			"can't assign to the location counter: %s", realName,
+		)
+	} else if _, ok := s.Internals.Lookup(realName); ok {
 		return ErrorListF(ESError,
 			"can't overwrite internal symbol: %s", realName,
 		)
@@ -262,10 +369,46 @@ func (s *SymMap) Set(name string, val asmVal, constant bool) ErrorList {
 			return fail()
 		}
 	}
-	s.Map[realName] = Symbol{Val: val, Constant: constant}
+	_, public := s.publics[realName]
+	delete(s.publics, realName)
+	public = public || s.Map[realName].Public
+	s.Map[realName] = Symbol{Val: val, Constant: constant, Public: public}
 	return nil
 }
 
+// SetPublic marks the symbol with the given name as public. If the symbol
+// doesn't exist yet, the flag is applied once it is defined through Set.
+func (s *SymMap) SetPublic(pos ItemPos, name string) ErrorList {
+	realName := s.ToSymCase(name)
+	if _, ok := s.Internals.Lookup(realName); ok {
+		return ErrorListF(ESError,
+			"can't make internal symbol public: %s", realName,
+		)
+	} else if existing, ok := s.Map[realName]; ok {
+		existing.Public = true
+		s.Map[realName] = existing
+	} else if _, ok := s.publics[realName]; !ok {
+		s.publics[realName] = pos
+	}
+	return nil
+}
+
+// UndefinedPublics returns a warning for every name that was declared as
+// PUBLIC, but never defined.
+func (s *SymMap) UndefinedPublics() (err ErrorList) {
+	var keys []string
+	for i := range s.publics {
+		keys = append(keys, i)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		err = err.AddFAt(s.publics[k], ESWarning,
+			"PUBLIC symbol was never defined: %s", k,
+		)
+	}
+	return err
+}
+
 // NewSymMap creates a new symbol map whose case sensitivity can be controlled
 // through the given pointer.
 func NewSymMap(caseSensitive *bool, internals *InternalSyms) *SymMap {
@@ -273,5 +416,6 @@ func NewSymMap(caseSensitive *bool, internals *InternalSyms) *SymMap {
 		Map:           make(map[string]Symbol),
 		CaseSensitive: caseSensitive,
 		Internals:     internals,
+		publics:       make(map[string]ItemPos),
 	}
 }
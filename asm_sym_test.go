@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+)
+
+func TestLocationCounter(t *testing.T) {
+	tests := []struct {
+		src  string
+		syms map[string]int64
+		err  string
+	}{
+		{
+			"d segment\nmsg db 'hello', 13, 10\nmsglen equ $ - msg\n" +
+				"tbl dw 1, 2, 3\ntbllen = ($ - tbl) / 2\nd ends\n",
+			map[string]int64{"msglen": 7, "tbllen": 3}, "",
+		}, {
+			// The offset of msg moves in pass 2.
+			"d segment\npad db n dup (?)\nmsg db 'ab'\nmsglen equ $ - msg\n" +
+				"n = 4\nd ends\n",
+			map[string]int64{"msglen": 2}, "phase error between passes: msg moved from offset 1h to 4h",
+		}, {
+			"d segment\nfoo db ?\na equ offset foo\na equ 5\nd ends\n",
+			map[string]int64{"a": 0}, "symbol already defined",
+		}, {
+			"d segment\nfoo db ?\nbar db ?\na equ offset bar\na equ offset foo\nd ends\n",
+			map[string]int64{"a": 1}, "symbol already defined",
+		}, {
+			"$ = 5\n", nil, "can't assign to the location counter",
+		},
+	}
+	for _, test := range tests {
+		p, err := parseString(t, test.src, ParseOptions{})
+		checkErrors(t, err, ESError, test.err)
+		for name, want := range test.syms {
+			if got := symInt(t, p, name); got != want {
+				t.Errorf("%s = %d, want %d", name, got, want)
+			}
+		}
+	}
+}
+
+func TestEQURedefinition(t *testing.T) {
+	tests := []struct {
+		src  string
+		want int64
+		err  string
+	}{
+		{"x equ 1\nx equ 1\n", 1, ""},
+		{"x equ 1\nx equ 2\n", 1, "symbol already defined"},
+		{"x equ 1\nx equ 2 - 1\n", 1, ""},
+		{"x = 1\nx = 2\n", 2, ""},
+	}
+	for _, test := range tests {
+		p, err := parseString(t, test.src, ParseOptions{})
+		checkErrors(t, err, ESError, test.err)
+		if got := symInt(t, p, "x"); got != test.want {
+			t.Errorf("%q: x = %d, want %d", test.src, got, test.want)
+		}
+	}
+}
+
+func TestLocationCounterAssignment(t *testing.T) {
+	for _, src := range []string{
+		"$ = 5\n",
+		"$ equ 5\n",
+		"d segment\n$ = 5\nd ends\n",
+		"d segment\n$ db 1\nd ends\n",
+	} {
+		_, err := parseString(t, src, ParseOptions{})
+		checkErrors(t, err, ESError, "can't assign to the location counter")
+	}
+}
+
+func TestSymMapEach(t *testing.T) {
+	p, err := parseString(t, "zeta = 1\nalpha = 2\nmid equ <x>\nd segment\nbeta db ?\nd ends\n", ParseOptions{})
+	checkErrors(t, err, ESWarning, "")
+	var names []string
+	visited := make(map[string]bool)
+	p.syms.Each(func(name string, sym Symbol) {
+		if sym != p.syms.Map[name] {
+			t.Errorf("%s: got %v, want %v", name, sym, p.syms.Map[name])
+		}
+		names = append(names, name)
+		visited[name] = true
+	})
+	if len(visited) != len(p.syms.Map) || len(names) != len(p.syms.Map) {
+		t.Errorf("visited %d symbols, want %d: %v", len(names), len(p.syms.Map), names)
+	}
+	if !sort.StringsAreSorted(names) {
+		t.Errorf("not in alphabetical order: %v", names)
+	}
+	for _, name := range []string{"ALPHA", "BETA", "D", "MID", "ZETA"} {
+		if !visited[name] {
+			t.Errorf("%s not visited: %v", name, names)
+		}
+	}
+}
+
+func TestEQUForwardReferences(t *testing.T) {
+	tests := []struct {
+		src  string
+		want int64
+		err  string
+	}{
+		{"x equ y + 1\ny = 5\nz = x\n", 6, ""},
+		{"x equ y + 1\nz = x\ny = 5\n", 6, ""},
+		{"x equ y + 1\nz = x\n", 0, "x is a text equate for <y + 1>, which refers to undefined symbols"},
+	}
+	for _, test := range tests {
+		p, err := parseString(t, test.src, ParseOptions{})
+		checkErrors(t, err, ESWarning, test.err)
+		if test.err != "" {
+			continue
+		}
+		if got := symInt(t, p, "z"); got != test.want {
+			t.Errorf("%q: z = %d, want %d", test.src, got, test.want)
+		}
+	}
+
+	p, err := parseString(t, "x equ y * 2\nd segment\ndb x\nd ends\ny equ 3\n", ParseOptions{})
+	checkErrors(t, err, ESWarning, "")
+	if got := segmentBytes(t, p, "d"); !bytes.Equal(got, []byte{6}) {
+		t.Errorf("got % x, want 06", got)
+	}
+}
+
+func TestCapturedLocationCounter(t *testing.T) {
+	src := "d segment\ndb 1, 2\nstart = $\ndw 3, 4\nmid label byte\ndb 5\n" +
+		"dist = $ - start\nstart = $\nd ends\n" +
+		"om = offset mid\n"
+	p, err := parseString(t, src, ParseOptions{})
+	checkErrors(t, err, ESWarning, "")
+	for name, want := range map[string]int64{"start": 7, "dist": 5, "om": 6} {
+		if got := symInt(t, p, name); got != want {
+			t.Errorf("%s = %d, want %d", name, got, want)
+		}
+	}
+
+	_, err = parseString(t, "x = $\n", ParseOptions{})
+	checkErrors(t, err, ESError, "the location counter ($) is only defined inside a segment or structure")
+}
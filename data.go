@@ -13,6 +13,7 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -62,7 +63,20 @@ type Blob struct {
 // to neighboring Blobs.
 type BlobList []Blob
 
+// Append adds data to the end of l, with ptr pointing to its first byte. Every
+// element of a DataArray gets its own blob.
 func (l BlobList) Append(ptr *asmPtr, data Emittable) BlobList {
+	switch data.(type) {
+	case DataArray:
+		for _, elm := range data.(DataArray) {
+			oldlen := len(l)
+			l = l.Append(ptr, elm)
+			if len(l) != oldlen {
+				ptr = nil
+			}
+		}
+		return l
+	}
 	datalen := data.Len()
 	if datalen > 0 {
 		first := Blob{Data: &data}
@@ -145,6 +159,88 @@ func (l BlobList) Expand(ptr *asmPtr, offset uint, newlen uint) BlobList {
 	return l
 }
 
+// split makes sure that no blob in l crosses the given offset, by replacing
+// any blob that does with two blobs holding its bytes before and after it.
+func (l BlobList) split(offset uint) {
+	if offset == 0 || offset >= uint(len(l)) {
+		return
+	}
+	target := l[offset].Data
+	if l[offset-1].Data != target {
+		return
+	}
+	start, end := offset, offset
+	for start > 0 && l[start-1].Data == target {
+		start--
+	}
+	for end < uint(len(l)) && l[end].Data == target {
+		end++
+	}
+	bytes := (*target).Emit()
+	var before Emittable = asmString(bytes[:offset-start])
+	var after Emittable = asmString(bytes[offset-start:])
+	for i := start; i < offset; i++ {
+		l[i].Data = &before
+	}
+	for i := offset; i < end; i++ {
+		l[i].Data = &after
+	}
+}
+
+// Overwrite replaces the bytes starting at the given offset with data, adds
+// ptr to the blob at that offset, and appends whatever part of data extends
+// beyond the end of l.
+func (l BlobList) Overwrite(ptr *asmPtr, offset uint, data Emittable) BlobList {
+	end := offset + data.Len()
+	l.split(offset)
+	l.split(end)
+	for i := offset; i < end && i < uint(len(l)); i++ {
+		l[i].Data = &data
+	}
+	if ptr != nil && offset < uint(len(l)) {
+		l[offset].Ptrs = append(l[offset].Ptrs, *ptr)
+	}
+	for i := uint(len(l)); i < end; i++ {
+		l = append(l, Blob{Data: &data})
+	}
+	return l
+}
+
+// uninitialized returns whether data only reserves space, without giving it
+// any initial value.
+func uninitialized(data Emittable) bool {
+	switch data.(type) {
+	case asmInt:
+		return data.(asmInt).uninit
+	case *DUPOperator:
+		return uninitialized(data.(*DUPOperator).data)
+	case DataArray:
+		for _, elm := range data.(DataArray) {
+			if !uninitialized(elm) {
+				return false
+			}
+		}
+		return len(data.(DataArray)) > 0
+	case asmStruc:
+		return data.(asmStruc).data.Uninitialized()
+	case *asmStruc:
+		return data.(*asmStruc).data.Uninitialized()
+	}
+	return false
+}
+
+// Uninitialized returns whether all data in l only reserves space. Such data
+// is emitted as zero bytes, but belongs into an uninitialized (BSS) section
+// when generating code.
+func (l BlobList) Uninitialized() bool {
+	for _, blob := range l {
+		if !uninitialized(*blob.Data) {
+			return false
+		}
+	}
+	return len(l) > 0
+}
+
 func (l BlobList) Emit() (ret []byte) {
 	var last *Emittable = nil
 	for _, cur := range l {
@@ -201,7 +297,11 @@ func (l BlobList) Dump(indent int) (ret string) {
 			} else {
 				ret += printSym(nil)
 			}
-			ret += fmt.Sprintf("% x", (*blob.Data).Emit())
+			if uninitialized(*blob.Data) {
+				ret += strings.TrimSpace(strings.Repeat("?? ", int((*blob.Data).Len())))
+			} else {
+				ret += fmt.Sprintf("% x", (*blob.Data).Emit())
+			}
 
 			switch (*blob.Data).(type) {
 			case *asmStruc:
@@ -224,17 +324,35 @@ type asmPtr struct {
 
 // asmDataPtr represents a pointer to data in a specific segment or structure.
 type asmDataPtr struct {
-	ptr   asmPtr
-	et    EmissionTarget
-	chunk uint
-	off   uint64
+	ptr      asmPtr
+	et       EmissionTarget // nil for external pointers
+	chunk    uint
+	off      uint64
+	external bool // Declared via EXTRN and defined in another module?
+	// Defined in pass 1, where offsets after forward references are only
+	// estimates?
+	pass1 bool
+	// Declaration of a member accessed through a structure instance, which
+	// can only be found in the structure type.
+	member *asmDataPtr
+	// Addressed using a far pointer? Data labels follow the data distance
+	// of the memory model.
+	far bool
 }
 
 func (p asmDataPtr) Thing() string {
+	if p.external {
+		return "external symbol"
+	}
 	return "data pointer"
 }
 
 func (p asmDataPtr) String() string {
+	if p.external && p.Width() == 0 {
+		return "(ABS) EXTRN"
+	} else if p.external {
+		return fmt.Sprintf("(%s*) EXTRN", p.ptr.unit.Name())
+	}
 	var offChars int = int(p.et.WordSize() * 2)
 	return fmt.Sprintf("(%s*) %s:%d:%0*xh",
 		p.ptr.unit.Name(), p.et.Name(), p.chunk, offChars, p.off,
@@ -245,6 +363,142 @@ func (p asmDataPtr) Width() uint {
 	return p.ptr.unit.Width()
 }
 
+// PtrWidth returns the number of bytes in a pointer to p.
+func (p asmDataPtr) PtrWidth() uint {
+	if p.et == nil {
+		return 0
+	} else if p.far {
+		return uint(p.et.WordSize()) + 2
+	}
+	return uint(p.et.WordSize())
+}
+
+// Size returns the number of bytes in the data declaration p points to, or
+// its unit width if there is no such declaration, or it hasn't been emitted
+// yet.
+func (p asmDataPtr) Size() uint {
+	if decl := p.declaration(); decl != nil {
+		return uint(len(decl))
+	}
+	return p.Width()
+}
+
+// FirstLength returns the number of elements in the DUP that starts the data
+// declaration p points to, or 1 if the declaration starts with any other
+// initializer.
+func (p asmDataPtr) FirstLength() uint {
+	if decl := p.declaration(); decl != nil && decl[0].Data != nil {
+		if dup, ok := (*decl[0].Data).(*DUPOperator); ok {
+			return uint(dup.count.Calc().n)
+		}
+	}
+	return 1
+}
+
+// declaration returns the blobs of the data declaration p points to, or nil
+// if there is no such declaration, or it hasn't been emitted yet. A
+// declaration ends at the next blob that starts another one. In pass 2,
+// declarations that haven't been emitted again yet are read from the data of
+// pass 1.
+func (p asmDataPtr) declaration() BlobList {
+	if p.member != nil {
+		return p.member.declaration()
+	}
+	var chunk BlobList
+	switch p.et.(type) {
+	case *asmSegment:
+		seg := p.et.(*asmSegment)
+		if p.chunk < uint(len(seg.chunks)) {
+			chunk = seg.chunks[p.chunk]
+		}
+		if p.off >= uint64(len(chunk)) && p.chunk < uint(len(seg.pass1Chunks)) {
+			chunk = seg.pass1Chunks[p.chunk]
+		}
+	case *asmStruc:
+		chunk = p.et.(*asmStruc).data
+	}
+	if p.off < uint64(len(chunk)) {
+		for _, ptr := range chunk[p.off].Ptrs {
+			if ptr.sym != nil && *ptr.sym == *p.ptr.sym {
+				end := p.off + 1
+				for end < uint64(len(chunk)) && len(chunk[end].Ptrs) == 0 {
+					end++
+				}
+				return chunk[p.off:end]
+			}
+		}
+	}
+	return nil
+}
+
+// RelocType describes which part of an address the linker has to fix up.
+type RelocType int
+
+const (
+	RelocOffset  RelocType = iota // Offset of the target within its segment
+	RelocSegment                  // Segment base of the target
+	RelocFar                      // Offset, followed by the segment base
+	RelocLow                      // Low byte of the offset of the target
+	RelocHigh                     // High byte of the offset of the target
+)
+
+func (t RelocType) String() string {
+	switch t {
+	case RelocSegment:
+		return "SEG"
+	case RelocFar:
+		return "FAR"
+	case RelocLow:
+		return "LOW OFFSET"
+	case RelocHigh:
+		return "HIGH OFFSET"
+	}
+	return "OFFSET"
+}
+
+// asmReloc represents an address stored in data, which would be a fixup in
+// a real object file.
+type asmReloc struct {
+	typ    RelocType
+	target string // Name of the target symbol in the symbol table
+	chunk  uint   // Location of the address, set once the data is emitted
+	off    uint64 // into a segment
+}
+
+func (r asmReloc) String() string {
+	return r.typ.String() + " " + r.target
+}
+
+// relocations returns all relocations in data, which starts at the given
+// offset within the given chunk.
+func relocations(data Emittable, chunk uint, off uint64) (ret []asmReloc) {
+	switch data.(type) {
+	case asmInt:
+		if reloc := data.(asmInt).reloc; reloc != nil {
+			ret = append(ret, *reloc)
+			ret[0].chunk = chunk
+			ret[0].off = off
+		}
+	case CalcToEmitOperator:
+		return relocations(data.(CalcToEmitOperator).Calc.Calc(), chunk, off)
+	case *DUPOperator:
+		dup := data.(*DUPOperator)
+		elms := relocations(dup.data, chunk, off)
+		for i := dup.count.Calc().n; i > 0 && len(elms) > 0; i-- {
+			ret = append(ret, elms...)
+			for j := range elms {
+				elms[j].off += uint64(dup.data.Len())
+			}
+		}
+	case DataArray:
+		for _, elm := range data.(DataArray) {
+			ret = append(ret, relocations(elm, chunk, off)...)
+			off += uint64(elm.Len())
+		}
+	}
+	return ret
+}
+
 type asmGroup struct {
 	name string
 	segs []*asmSegment
@@ -265,6 +519,23 @@ func (g asmGroup) String() string {
 	return ret + "]"
 }
 
+// Offset returns the offset of the start of seg within g, assuming that the
+// linker places the segments of g in the order of their declaration.
+func (g *asmGroup) Offset(seg *asmSegment) (off uint64) {
+	segs := append([]*asmSegment{}, g.segs...)
+	sort.Slice(segs, func(i, j int) bool { return segs[i].index < segs[j].index })
+	for _, s := range segs {
+		if align := uint64(s.align); align > 1 {
+			off = (off + align - 1) / align * align
+		}
+		if s == seg {
+			break
+		}
+		off += uint64(s.finalWidth())
+	}
+	return off
+}
+
 func (g *asmGroup) Add(seg *asmSegment) (err ErrorList) {
 	if seg.group != nil && seg.group != g {
 		return err.AddF(ESError,
@@ -284,6 +555,16 @@ type asmSegment struct {
 	group      *asmGroup
 	overflowed bool
 	wordsize   uint8
+	index      uint // Order of declaration, used as the value of SEG
+	align      uint // Alignment of the start of the segment, in bytes
+	pass1Width uint // Size at the end of pass 1
+	// Data at the end of pass 1, for the sizes of declarations that pass 2
+	// hasn't reached yet.
+	pass1Chunks []BlobList
+	// Location counter set by ORG, as long as it points into existing data
+	// of the last chunk.
+	org    *uint64
+	relocs []asmReloc
 }
 
 type asmSegmentBlock struct {
@@ -315,32 +596,122 @@ func (s asmSegment) width() uint {
 	return uint(ret)
 }
 
+// finalWidth returns the size of s after all of its data has been emitted,
+// as far as it is known.
+func (s asmSegment) finalWidth() uint {
+	if width := s.width(); width > s.pass1Width {
+		return width
+	}
+	return s.pass1Width
+}
+
+// Reset removes all data from s, remembering its size.
+func (s *asmSegment) Reset() {
+	s.pass1Width = s.width()
+	s.pass1Chunks = s.chunks
+	s.chunks = nil
+	s.overflowed = false
+	s.org = nil
+	s.relocs = nil
+}
+
 func (s *asmSegment) AddData(ptr *asmPtr, data Emittable) (err ErrorList) {
 	maxSize := uint64((1 << (s.wordsize * 8)) - 1)
-	if uint64(data.Len()+s.width()) > maxSize && !s.overflowed {
-		s.overflowed = true
-		err = err.AddF(ESError,
-			"declaration overflows %d-bit segment: %s", s.wordsize*8, s.Name(),
-		)
+	// The location counter continues wherever the segment was left, which
+	// might be in the middle of existing data.
+	_, start := s.Offset()
+	if end := start + uint64(data.Len()); end > 0 && end-1 > maxSize {
+		// Large DUP counts would otherwise allocate one blob for every
+		// single byte, way beyond what the segment could ever hold.
+		if !s.overflowed {
+			s.overflowed = true
+			err = err.AddF(ESError,
+				"declaration overflows %d-bit segment: %s",
+				s.wordsize*8, s.Name(),
+			)
+		}
+		return err
 	}
 	if len(s.chunks) == 0 {
 		s.chunks = make([]BlobList, 1)
 	}
 	chunk := len(s.chunks) - 1
+	s.addRelocs(uint(chunk), start, data)
+	if s.org != nil {
+		off := *s.org
+		end := off + uint64(data.Len())
+		if overlap := uint64(len(s.chunks[chunk])); overlap > off {
+			if overlap > end {
+				overlap = end
+			}
+			if overlap -= off; overlap > 0 {
+				err = err.AddF(ESWarning,
+					"overwriting %d bytes of data at offset %0*xh in segment %s",
+					overlap, s.wordsize*2, off, s.Name(),
+				)
+			}
+		}
+		s.chunks[chunk] = s.chunks[chunk].Overwrite(ptr, uint(off), data)
+		if end < uint64(len(s.chunks[chunk])) {
+			s.org = &end
+		} else {
+			s.org = nil
+		}
+		return err
+	}
 	s.chunks[chunk] = s.chunks[chunk].Append(ptr, data)
 	return err
 }
 
+// addRelocs adds the relocations in data, emitted at the given offset within
+// the given chunk, to s, replacing any existing ones in the same range.
+func (s *asmSegment) addRelocs(chunk uint, off uint64, data Emittable) {
+	end := off + uint64(data.Len())
+	kept := s.relocs[:0]
+	for _, reloc := range s.relocs {
+		if reloc.chunk != chunk || reloc.off < off || reloc.off >= end {
+			kept = append(kept, reloc)
+		}
+	}
+	s.relocs = append(kept, relocations(data, chunk, off)...)
+}
+
+// SetOrg moves the location counter to the given offset within the last data
+// chunk, padding the chunk with null bytes if necessary.
+func (s *asmSegment) SetOrg(off uint64) ErrorList {
+	s.org = nil
+	_, end := s.Offset()
+	if off > end {
+		padding := asmString(strings.Repeat("\x00", int(off-end)))
+		return s.AddData(nil, padding)
+	} else if off < end {
+		s.org = &off
+	}
+	return nil
+}
+
 func (s *asmSegment) Offset() (chunk uint, off uint64) {
 	if len(s.chunks) != 0 {
 		chunk = uint(len(s.chunks) - 1)
 		off = uint64(len(s.chunks[chunk]))
 	}
+	if s.org != nil {
+		off = *s.org
+	}
 	return chunk, off
 }
 
 func (s *asmSegment) AddPointer(p *parser, sym string, ptr asmDataPtr) (err ErrorList) {
-	return p.syms.Set(sym, ptr, true)
+	// Everything before this declaration saw the offset from pass 1.
+	prev, _ := p.syms.Map[p.syms.ToSymCase(sym)].Val.(asmDataPtr)
+	if !ptr.pass1 && prev.pass1 && prev.et == ptr.et &&
+		(prev.chunk != ptr.chunk || prev.off != ptr.off) {
+		err = err.AddF(ESError,
+			"phase error between passes: %s moved from offset %xh to %xh",
+			sym, prev.off, ptr.off,
+		)
+	}
+	return err.AddL(p.syms.Set(sym, ptr, true))
 }
 
 func (p *parser) CurrentEmissionTarget() EmissionTarget {
@@ -353,35 +724,124 @@ func (p *parser) CurrentEmissionTarget() EmissionTarget {
 	return nil
 }
 
-func (p *parser) EmitPointer(sym string, unit DataUnit) (err ErrorList) {
+// location returns a pointer to the current position within the current
+// emission target, which is the value of $, or nil outside of any target.
+func (p *parser) location() asmVal {
+	et := p.CurrentEmissionTarget()
+	if et == nil {
+		return nil
+	}
+	chunk, off := et.Offset()
+	// Makes relocations refer to the start of the segment.
+	name := et.Name()
+	return asmDataPtr{
+		ptr: asmPtr{sym: &name, unit: SimpleData(0)}, et: et, chunk: chunk, off: off,
+	}
+}
+
+// EmitPointer defines sym as a label of the given unit at the current
+// location, with the given distance (NEAR, FAR, PROC, or DATAPTR for data
+// labels).
+func (p *parser) EmitPointer(sym string, unit DataUnit, distance string) (err ErrorList) {
 	if sym == "" {
 		return err
 	}
 	et := p.CurrentEmissionTarget()
 	chunk, off := et.Offset()
-	ptr := asmDataPtr{ptr: asmPtr{sym: &sym, unit: unit}, et: et, chunk: chunk}
-	if p.pass2 {
-		ptr.off = off
+	ptr := asmDataPtr{
+		ptr: asmPtr{sym: &sym, unit: unit}, et: et, chunk: chunk, off: off,
+		pass1: !p.pass2,
+	}
+	// Structure members are only addressed through their instance.
+	if _, ok := et.(*asmSegment); ok {
+		wordsize := et.WordSize()
+		ptr.far = p.intSyms.PtrWidth(distance, wordsize) > uint(wordsize)
 	}
 	return et.AddPointer(p, sym, ptr)
 }
 
 func (p *parser) EmitData(it *item, unit DataUnit) (err ErrorList) {
-	err = p.EmitPointer(it.sym, unit)
+	err = p.EmitPointer(it.sym, unit, "DATAPTR")
+
+	// Data is emitted in both passes, so that pass 2 knows the offsets of
+	// all symbols declared after the current one. Segments are emptied again
+	// before pass 2 starts.
+	ptr := &asmPtr{sym: &it.sym, unit: unit}
+	data, errText := p.expandTextMacros(it.params[0])
+	err = err.AddL(errText)
+	blob, errData := p.syms.evalData(it.pos, data, unit)
+	err = err.AddL(errData)
+	if errData.Severity() < ESError {
+		err = err.AddL(p.CurrentEmissionTarget().AddData(ptr, blob))
+	} else if !p.pass2 && len(p.strucs) == 0 {
+		// Most likely a forward reference. Reserving the space the
+		// declaration will most likely take keeps the following offsets
+		// correct; pass 2 reports a phase error if they aren't.
+		placeholder := asmString(make([]byte, p.placeholderLen(it.pos, data, unit)))
+		p.CurrentEmissionTarget().AddData(ptr, placeholder)
+	}
+	return err
+}
 
-	// In structures, we need to emit data even in pass 1 in order to have
-	// their size at the beginning of pass 2. In segments, we don't; in fact,
-	// doing so effectively emits all data twice, with all pointers pointing to
-	// the second, unnecessary copy.
-	if p.pass2 || len(p.strucs) > 0 {
-		blob, errData := p.syms.evalData(it.pos, it.params[0], unit)
-		err = err.AddL(errData)
-		if errData.Severity() < ESError {
-			ptr := &asmPtr{sym: &it.sym, unit: unit}
-			err = err.AddL(p.CurrentEmissionTarget().AddData(ptr, blob))
+// placeholderLen estimates the number of bytes emitted by the data
+// declaration expr, which can't be evaluated yet. Values that can't be
+// evaluated on their own take a single unit, and DUP counts that can't be
+// evaluated are assumed to be 1.
+func (p *parser) placeholderLen(pos ItemPos, expr string, unit DataUnit) (ret uint) {
+	stream := NewLexStreamAt(pos, expr)
+	for {
+		if value := strings.TrimSpace(stream.nextParam(0)); value != "" {
+			ret += p.placeholderValueLen(pos, value, unit)
+		}
+		if stream.next() == eof {
+			return ret
 		}
 	}
-	return err
+}
+
+// placeholderValueLen estimates the number of bytes emitted by the single
+// data value s.
+func (p *parser) placeholderValueLen(pos ItemPos, s string, unit DataUnit) uint {
+	if data, err := p.syms.evalData(pos, s, unit); err.Severity() < ESError {
+		return data.Len()
+	} else if count, data, ok := splitDUP(s); ok {
+		n := uint(1)
+		if c, errCount := p.syms.evalInt(pos, count); errCount.Severity() < ESError && c.n > 0 {
+			n = uint(c.n)
+		}
+		return n * p.placeholderLen(pos, data, unit)
+	}
+	return unit.Width()
+}
+
+// splitDUP splits the single data value s into the count and data of a DUP
+// operator, if it has one outside of any parentheses.
+func splitDUP(s string) (count, data string, ok bool) {
+	level := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\'', '"':
+			if end := strings.IndexByte(s[i+1:], s[i]); end != -1 {
+				i += end + 1
+			}
+		case '(', '<':
+			level++
+		case ')', '>':
+			level--
+		default:
+			if level != 0 || i+3 > len(s) || !strings.EqualFold(s[i:i+3], opDup) ||
+				(i > 0 && isSymbolChar(s[i-1])) ||
+				(i+3 < len(s) && isSymbolChar(s[i+3])) {
+				continue
+			}
+			data = strings.TrimSpace(s[i+3:])
+			if len(data) >= 2 && data[0] == '(' && data[len(data)-1] == ')' {
+				data = data[1 : len(data)-1]
+			}
+			return s[:i], data, true
+		}
+	}
+	return s, "", false
 }
 
 func (p *parser) AddToDGroup(seg *asmSegment) (err ErrorList) {
@@ -404,7 +864,15 @@ func (p *parser) GetSegment(name string, addToDGroup bool) (*asmSegment, ErrorLi
 			// We'll have SymMap.Set handle this error message.
 		}
 	}
-	seg := &asmSegment{name: name, wordsize: p.intSyms.SegmentWordSize()}
+	seg := &asmSegment{
+		name: name, wordsize: p.intSyms.SegmentWordSize(), align: 16,
+	}
+	for _, sym := range p.syms.Map {
+		switch sym.Val.(type) {
+		case *asmSegment:
+			seg.index++
+		}
+	}
 	err = err.AddL(p.syms.Set(name, seg, false))
 	if err.Severity() < ESError && addToDGroup {
 		err = err.AddL(p.AddToDGroup(seg))
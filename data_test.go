@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestForwardReferences(t *testing.T) {
+	src := "d segment\n" +
+		"s = sizeof arr\n" +
+		"l = lengthof arr\n" +
+		"o = offset arr\n" +
+		"e = fin - arr\n" +
+		"pad db 3 dup (?)\n" +
+		"arr dw 1, 2, 3, 4\n" +
+		"fin label byte\n" +
+		"d ends\n"
+	p, err := parseString(t, src, ParseOptions{})
+	checkErrors(t, err, ESWarning, "")
+	for name, want := range map[string]int64{"s": 8, "l": 4, "o": 3, "e": 8} {
+		if got := symInt(t, p, name); got != want {
+			t.Errorf("%s = %d, want %d", name, got, want)
+		}
+	}
+}
+
+func TestForwardReferencePlaceholders(t *testing.T) {
+	tests := []struct {
+		data string
+		want int64
+		err  string
+	}{
+		{"x dw fwd, fwd, fwd", 7, ""},
+		{"x dw 3 dup (fwd)", 7, ""},
+		{"x dw 2 dup (fwd, 1), fwd", 11, ""},
+		{"x db 'ab', fwd", 4, ""},
+		{"x dd fwd", 5, ""},
+		{"x db fwd2 dup (fwd)", 3, "phase error between passes: y moved from offset 2h to 3h"},
+	}
+	for _, test := range tests {
+		src := "d segment\na db low offset y\n" + test.data + "\ny db 0\nd ends\n" +
+			"fwd = 1\nfwd2 = 2\no = offset y\n"
+		p, err := parseString(t, src, ParseOptions{})
+		checkErrors(t, err, ESError, test.err)
+		if got := symInt(t, p, "o"); got != test.want {
+			t.Errorf("%s: offset y = %d, want %d", test.data, got, test.want)
+		}
+		if test.err != "" {
+			continue
+		}
+		// Earlier references must see the final offset.
+		if got := segmentBytes(t, p, "d")[0]; int64(got) != test.want {
+			t.Errorf("%s: a = %d, want %d", test.data, got, test.want)
+		}
+	}
+}
+
+func TestLabelDistance(t *testing.T) {
+	tests := []struct {
+		model string
+		sym   string
+		width uint
+	}{
+		{"small", "x", 2},
+		{"compact", "x", 4},
+		{"large", "x", 4},
+		{"medium", "x", 2},
+		{"compact", "n", 2},
+		{"small", "f", 4},
+	}
+	for _, test := range tests {
+		src := ".model " + test.model + "\n.data\nx dw ?\n.code\nn label near\nf label far\nend\n"
+		p, err := parseString(t, src, ParseOptions{})
+		checkErrors(t, err, ESError, "")
+		val, _ := p.syms.Get(test.sym)
+		ptr, ok := val.(asmDataPtr)
+		if !ok {
+			t.Fatalf("%s is not a label: %v", test.sym, val)
+		} else if got := ptr.PtrWidth(); got != test.width {
+			t.Errorf("%s model: pointer to %s has %d bytes, want %d",
+				test.model, test.sym, got, test.width,
+			)
+		}
+	}
+
+	// Procedures aren't data.
+	p, _ := parseString(t, ".model small\n.data\np proc\np endp\nend\n", ParseOptions{})
+	if val, _ := p.syms.Lookup("p"); val != nil {
+		t.Errorf("procedure defined as %s", val.Thing())
+	}
+
+	// Storing the address of a far data label in a word drops its segment.
+	for model, warn := range map[string]string{"small": "", "compact": "far label x"} {
+		src := ".model " + model + "\n.data\nx dw ?\ny dw x\nz dd x\nend\n"
+		_, err := parseString(t, src, ParseOptions{})
+		checkErrors(t, err, ESWarning, warn)
+	}
+}
+
+func TestORG(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []byte
+		err  string
+	}{
+		{"d segment\ndb 1, 2, 3\norg 1\ndb 4\nd ends\n", []byte{1, 4, 3}, "overwriting 1 bytes"},
+		{"d segment\ndb 1\norg 3\ndb 4\nd ends\n", []byte{1, 0, 0, 4}, ""},
+		{"d segment\ndb 1\ns struc\norg 1\ns ends\nd ends\n", []byte{1}, "ORG"},
+	}
+	for _, test := range tests {
+		p, err := parseString(t, test.src, ParseOptions{})
+		checkErrors(t, err, ESWarning, test.err)
+		if got := segmentBytes(t, p, "d"); !bytes.Equal(got, test.want) {
+			t.Errorf("%q: got % x, want % x", test.src, got, test.want)
+		}
+	}
+}
+
+func TestReopenedSegments(t *testing.T) {
+	src := "d segment\na db 1, 2\nd ends\n" +
+		"e segment\ndb 9\ne ends\n" +
+		"d segment\nhere = $\nb db 3\nd ends\n" +
+		"e segment\nc db 8\ne ends\n" +
+		"d segment\nfin label byte\nd ends\n" +
+		"ob = offset b\noc = offset c\nof = offset fin\n"
+	p, err := parseString(t, src, ParseOptions{})
+	checkErrors(t, err, ESWarning, "")
+	for name, want := range map[string]int64{"here": 2, "ob": 2, "oc": 1, "of": 3} {
+		if got := symInt(t, p, name); got != want {
+			t.Errorf("%s = %d, want %d", name, got, want)
+		}
+	}
+	for seg, want := range map[string][]byte{"d": {1, 2, 3}, "e": {9, 8}} {
+		if got := segmentBytes(t, p, seg); !bytes.Equal(got, want) {
+			t.Errorf("%s: got % x, want % x", seg, got, want)
+		}
+	}
+
+	tests := []struct {
+		src string
+		err string
+	}{
+		{"d segment\ndb 0FFFFh dup (0)\nd ends\nd segment\ndb 1\nd ends\n", ""},
+		{"d segment\ndb 0FFFFh dup (0)\nd ends\nd segment\ndb 1, 2\nd ends\n", "declaration overflows 16-bit segment: d"},
+		{"d segment\ndb 10000h dup (0)\norg 0FFFEh\nd ends\nd segment\ndb 1, 2\nd ends\n", "overwriting 2 bytes"},
+	}
+	for _, test := range tests {
+		_, err := parseString(t, test.src, ParseOptions{})
+		checkErrors(t, err, ESWarning, test.err)
+	}
+}
+
+func TestAlign(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []byte
+	}{
+		{"db 1\nalign 4\ndb 2\n", []byte{1, 0, 0, 0, 2}},
+		{"db 1, 2, 3, 4\nalign 4\ndb 2\n", []byte{1, 2, 3, 4, 2}},
+		{"db 1\neven\ndb 2\neven\n", []byte{1, 0, 2, 0}},
+		{"db 1\nalign 1\ndb 2\n", []byte{1, 2}},
+		{"s struc\na db ?\nalign 2\nb dw ?\ns ends\nsz = size s\ndb sz\n", []byte{4}},
+	}
+	for _, test := range tests {
+		p, err := parseString(t, "d segment\n"+test.src+"d ends\n", ParseOptions{})
+		checkErrors(t, err, ESWarning, "")
+		if got := segmentBytes(t, p, "d"); !bytes.Equal(got, test.want) {
+			t.Errorf("%q: got % x, want % x", test.src, got, test.want)
+		}
+	}
+
+	for _, src := range []string{"align 2\n", "even\n", "org 100h\n"} {
+		_, err := parseString(t, src, ParseOptions{})
+		checkErrors(t, err, ESError, "requires a segment")
+	}
+	_, err := parseString(t, "d segment\nalign 0\nd ends\n", ParseOptions{})
+	checkErrors(t, err, ESError, "alignment must be a power of 2: 0")
+}
+
+func TestStructArrayMembers(t *testing.T) {
+	src := "POINT STRUC\nx DW ?\ny DW ?\nPOINT ENDS\n" +
+		"d segment\npad db 6 dup (?)\narr POINT 10 DUP (<>)\nd ends\n"
+	tests := []struct {
+		syntax, expr string
+		want         int64
+	}{
+		{"TASM", "offset arr[3 * SIZE POINT].y", 6 + 3*4 + 2},
+		{"MASM", "(arr + 3 * SIZEOF POINT).y", 6 + 3*4 + 2},
+		{"MASM", "offset arr[12].y", 6 + 12 + 2},
+		{"MASM", "(arr + 3 * SIZEOF POINT).y - arr", 3*4 + 2},
+		{"MASM", "offset arr.y", 6 + 2},
+	}
+	for _, test := range tests {
+		p, err := parseString(t, src+"r = "+test.expr+"\n", ParseOptions{Syntax: test.syntax})
+		checkErrors(t, err, ESWarning, "")
+		if got := symInt(t, p, "r"); got != test.want {
+			t.Errorf("%s: %s = %d, want %d", test.syntax, test.expr, got, test.want)
+		}
+	}
+}
+
+func TestGroupOffsets(t *testing.T) {
+	tests := []struct {
+		src  string
+		want int64
+	}{
+		{"g group a, b\na segment byte\ndb 3 dup (0)\na ends\nb segment byte\nx db 1\nb ends\n", 3},
+		{"a segment byte\ndb 3 dup (0)\na ends\nb segment word\nx db 1\nb ends\ng group a, b\n", 4},
+		{"a segment para\ndb 3 dup (0)\na ends\nb segment para\ndb 2\nx db 1\nb ends\ng group a, b\n", 17},
+		{"a segment byte\ndb 3 dup (0)\na ends\nb segment byte\nx db 1\nb ends\ng group b, a\n", 3},
+		{"a segment byte\nx db 1\na ends\nb segment byte\ndb 3 dup (0)\nb ends\ng group a, b\n", 0},
+		{"a segment byte\ndb 3 dup (0)\na ends\nb segment byte\nx db 1\nb ends\n", 0},
+	}
+	for _, test := range tests {
+		p, err := parseString(t, test.src+"o = offset x\n", ParseOptions{})
+		checkErrors(t, err, ESWarning, "")
+		if got := symInt(t, p, "o"); got != test.want {
+			t.Errorf("%q: offset x = %d, want %d", test.src, got, test.want)
+		}
+	}
+}
+
+func TestDataTextMacros(t *testing.T) {
+	tests := []struct {
+		data string
+		want []byte
+		err  string
+	}{
+		{"db %msg", []byte("hi"), ""},
+		{"db %msg, 0", []byte("hi\x00"), ""},
+		{"db %num, %num + 1", []byte{7, 8}, ""},
+		{"db '%msg'", []byte("%msg"), ""},
+		{"db %undefined", nil, "UNDEFINED"},
+	}
+	for _, test := range tests {
+		src := "msg equ <'hi'>\nnum equ <7>\nd segment\n" + test.data + "\nd ends\n"
+		p, err := parseString(t, src, ParseOptions{})
+		checkErrors(t, err, ESWarning, test.err)
+		if got := segmentBytes(t, p, "d"); !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got % x, want % x", test.data, got, test.want)
+		}
+	}
+}
+
+func TestOffsetsInBytes(t *testing.T) {
+	tests := []struct {
+		data string
+		want []byte
+		err  string
+	}{
+		{"db offset sym", []byte{2}, "storing the offset of SYM in a single byte"},
+		{"db low offset sym", []byte{2}, ""},
+		{"db high offset sym", []byte{0}, ""},
+		{"db 2", []byte{2}, ""},
+	}
+	for _, test := range tests {
+		src := "d segment\ndw ?\nsym db 0\nd ends\ne segment\n" + test.data + "\ne ends\n"
+		p, err := parseString(t, src, ParseOptions{})
+		checkErrors(t, err, ESWarning, test.err)
+		if got := segmentBytes(t, p, "e"); !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got % x, want % x", test.data, got, test.want)
+		}
+	}
+}
+
+func TestEquatedExpressionData(t *testing.T) {
+	tests := []struct {
+		data string
+		size int64
+		want []byte
+		err  string
+	}{
+		{"v db x", 1, []byte{3}, ""},
+		{"v db x, x * 2", 2, []byte{3, 6}, ""},
+		{"v db t", 1, []byte{3}, ""},
+		{"v dd x", 4, nil, ""},
+		{"v db big", 0, nil, "number exceeds 8 bits"},
+		{"v db x * big", 0, nil, "number exceeds 8 bits"},
+	}
+	for _, test := range tests {
+		src := "x equ 1 + 2\nt equ <1 + 2>\nbig equ 100h\nd segment\n" + test.data +
+			"\nd ends\n"
+		p, err := parseString(t, src, ParseOptions{})
+		checkErrors(t, err, ESWarning, test.err)
+		if test.err != "" {
+			continue
+		}
+		got := segmentBytes(t, p, "d")
+		if int64(len(got)) != test.size {
+			t.Errorf("%s: got %d bytes, want %d", test.data, len(got), test.size)
+		} else if test.want != nil && !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got % x, want % x", test.data, got, test.want)
+		}
+	}
+}
+
+func TestRelocations(t *testing.T) {
+	src := "d segment\npad db 3 dup (0)\nx db 0\nd ends\n" +
+		"e segment\ndb 0\np dw offset x\nq dd x\nr dw seg x\ns dw 5\ne ends\n"
+	p, err := parseString(t, src, ParseOptions{})
+	checkErrors(t, err, ESWarning, "")
+	val, _ := p.syms.Get("e")
+	seg := val.(*asmSegment)
+	want := []asmReloc{
+		{typ: RelocOffset, target: "X", off: 1},
+		{typ: RelocFar, target: "X", off: 3},
+		{typ: RelocSegment, target: "X", off: 7},
+	}
+	if len(seg.relocs) != len(want) {
+		t.Fatalf("got %d relocations, want %d: %v", len(seg.relocs), len(want), seg.relocs)
+	}
+	for i, reloc := range seg.relocs {
+		if reloc.typ != want[i].typ || reloc.target != want[i].target ||
+			reloc.chunk != 0 || reloc.off != want[i].off {
+			t.Errorf("relocation %d: got %+v, want %+v", i, reloc, want[i])
+		}
+	}
+	val, _ = p.syms.Get("d")
+	if relocs := val.(*asmSegment).relocs; len(relocs) != 0 {
+		t.Errorf("relocations in segment without addresses: %v", relocs)
+	}
+}
+
+func TestUninitializedData(t *testing.T) {
+	src := "d segment\nz dw 0\nr dw ?\nfin label byte\nd ends\n"
+	p, err := parseString(t, src, ParseOptions{})
+	checkErrors(t, err, ESWarning, "")
+	if got := segmentBytes(t, p, "d"); !bytes.Equal(got, []byte{0, 0, 0, 0}) {
+		t.Errorf("got % x, want 00 00 00 00", got)
+	}
+	for name, want := range map[string]int64{"r": 2, "fin": 4} {
+		p, err := parseString(t, src+"o = offset "+name+"\n", ParseOptions{})
+		checkErrors(t, err, ESWarning, "")
+		if got := symInt(t, p, "o"); got != want {
+			t.Errorf("offset %s = %d, want %d", name, got, want)
+		}
+	}
+
+	var buf bytes.Buffer
+	EmitLayout(&buf, &p.syms)
+	checkOutput(t, buf.String(), []string{
+		"z: 2 bytes (1 × 2 bytes)\n",
+		"r: 2 bytes (1 × 2 bytes), uninitialized\n",
+	})
+	checkOutput(t, emitC(t, src), []string{"uint16_t z = 0;", "uint16_t r;"})
+}
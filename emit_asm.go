@@ -0,0 +1,44 @@
+// Reconstructed assembly output.
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// Expanded returns all items in instructions outside of macro definitions and
+// repeat blocks. Since their expansions directly follow them, and
+// conditional and INCLUDE directives are never kept, this results in
+// fully preprocessed code. CPU instructions also use their operands with all
+// aliases expanded.
+func Expanded(instructions []item) (ret []item) {
+	nest := 0
+	for _, it := range instructions {
+		if it.typ == itemInstruction && Keywords[it.val].Type&Macro != 0 {
+			if it.val == "ENDM" {
+				nest--
+			} else {
+				nest++
+			}
+			continue
+		} else if nest == 0 {
+			if it.operands != nil {
+				it.params = it.operands
+			}
+			ret = append(ret, it)
+		}
+	}
+	return ret
+}
+
+// EmitAsm writes instructions to w as assembly code, with all integer
+// constants converted to the given base, or left as they are if base is 0.
+func EmitAsm(w io.Writer, instructions []item, base uint8) {
+	for _, it := range instructions {
+		if base != 0 {
+			it = it.Rebase(base)
+		}
+		fmt.Fprintln(w, it)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestEmitExpanded(t *testing.T) {
+	checkGolden(t, "expanded", func(w io.Writer, p *parser) {
+		EmitAsm(w, Expanded(p.instructions), 0)
+	})
+}
+
+func TestOperandAliases(t *testing.T) {
+	src := "c segment\np equ ds:[bx+2]\nr = es:di\nmov ax, p\nmov r, ax\nc ends\n"
+	p, err := parseString(t, src, ParseOptions{})
+	checkErrors(t, err, ESWarning, "")
+	for _, test := range []struct {
+		instructions []item
+		want         []string
+	}{
+		{p.instructions, []string{"mov\tax, p", "mov\tr, ax"}},
+		{Expanded(p.instructions), []string{"mov\tax, ds:[bx+2]", "mov\tes:di, ax"}},
+	} {
+		var buf bytes.Buffer
+		EmitAsm(&buf, test.instructions, 0)
+		for _, line := range test.want {
+			if !strings.Contains(buf.String(), line) {
+				t.Errorf("missing %q in:\n%s", line, buf.String())
+			}
+		}
+	}
+}
+
+func TestEmitAsmBase(t *testing.T) {
+	src := "d segment\ndb 10, 0Fh, 101b, 17o\ndw 'AB', -2\ndd 1.5e+2\nd ends\n"
+	p, err := parseString(t, src, ParseOptions{})
+	checkErrors(t, err, ESWarning, "")
+	for base, want := range map[uint8][]string{
+		0:  {"DB\t10, 0Fh, 101b, 17o\n", "DW\t'AB', -2\n", "DD\t1.5e+2\n"},
+		16: {"DB\t0ah, 0fh, 5h, 0fh\n", "DW\t'AB', -2h\n", "DD\t1.5e+2\n"},
+		10: {"DB\t10, 15, 5, 15\n", "DW\t'AB', -2\n"},
+	} {
+		var buf bytes.Buffer
+		EmitAsm(&buf, p.instructions, base)
+		checkOutput(t, buf.String(), want)
+	}
+}
@@ -0,0 +1,581 @@
+// C output.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// isCIdent returns whether s is a valid C identifier.
+func isCIdent(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		alpha := (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || c == '_'
+		if !alpha && !(i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// cReserved lists the C keywords and the type names used in the output,
+// none of which can be used as an identifier.
+var cReserved = map[string]bool{
+	"auto": true, "break": true, "case": true, "char": true, "const": true,
+	"continue": true, "default": true, "do": true, "double": true,
+	"else": true, "enum": true, "extern": true, "float": true, "for": true,
+	"goto": true, "if": true, "inline": true, "int": true, "long": true,
+	"register": true, "restrict": true, "return": true, "short": true,
+	"signed": true, "sizeof": true, "static": true, "struct": true,
+	"switch": true, "typedef": true, "union": true, "unsigned": true,
+	"void": true, "volatile": true, "while": true, "_Bool": true,
+	"_Complex": true, "_Imaginary": true,
+	"uint8_t": true, "uint16_t": true, "uint32_t": true, "uint64_t": true,
+}
+
+// cName returns the C identifier for the assembly symbol s, which is s
+// itself unless it is reserved in C, in which case an underscore is
+// appended.
+func cName(s string) string {
+	if cReserved[s] {
+		return s + "_"
+	}
+	return s
+}
+
+// cQuote returns s as a C literal enclosed in the given quote character,
+// escaping every byte that would otherwise not be represented verbatim.
+func cQuote(s string, quote byte) string {
+	ret := []byte{quote}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '\\', quote:
+			ret = append(ret, '\\', c)
+		case '\a':
+			ret = append(ret, '\\', 'a')
+		case '\b':
+			ret = append(ret, '\\', 'b')
+		case '\f':
+			ret = append(ret, '\\', 'f')
+		case '\n':
+			ret = append(ret, '\\', 'n')
+		case '\r':
+			ret = append(ret, '\\', 'r')
+		case '\t':
+			ret = append(ret, '\\', 't')
+		case '\v':
+			ret = append(ret, '\\', 'v')
+		case '?':
+			// Don't accidentally form a trigraph.
+			if i > 0 && s[i-1] == '?' {
+				ret = append(ret, '\\')
+			}
+			ret = append(ret, c)
+		default:
+			if c >= 0x20 && c < 0x7F {
+				ret = append(ret, c)
+			} else if next := i + 1; c == 0 &&
+				(next == len(s) || s[next] < '0' || s[next] > '7') {
+				ret = append(ret, '\\', '0')
+			} else {
+				// Always using three digits ensures that following
+				// digits don't become part of the escape sequence.
+				ret = append(ret, fmt.Sprintf("\\%03o", c)...)
+			}
+		}
+	}
+	return string(append(ret, quote))
+}
+
+// CString returns v as a C string literal.
+func (v asmString) CString() string {
+	return cQuote(string(v), '"')
+}
+
+// CString returns v as a C integer constant, preserving its base where C
+// has an equivalent notation.
+func (v asmInt) CString() string {
+	sign := ""
+	n := uint64(v.n)
+	if v.n < 0 {
+		sign = "-"
+		n = uint64(-v.n)
+	}
+	switch v.base {
+	case 8:
+		if n != 0 {
+			return sign + "0" + strconv.FormatUint(n, 8)
+		}
+	case 2, 16:
+		// C has no binary literals, so hex is the next best thing.
+		return sign + "0x" + strconv.FormatUint(n, 16)
+	case 255:
+		if n < 0x100 && sign == "" {
+			return cQuote(string([]byte{byte(n)}), '\'')
+		}
+		return sign + "0x" + strconv.FormatUint(n, 16)
+	}
+	return sign + strconv.FormatUint(n, 10)
+}
+
+// EmitCDefines writes a #define for every integer constant and text equate
+// in syms to w, in alphabetical order.
+func EmitCDefines(w io.Writer, syms *SymMap) {
+	syms.Each(func(name string, sym Symbol) {
+		if !isCIdent(name) {
+			return
+		}
+		switch sym.Val.(type) {
+		case asmInt:
+			num := sym.Val.(asmInt).CString()
+			if num[0] == '-' {
+				num = "(" + num + ")"
+			}
+			fmt.Fprintf(w, "#define %s %s\n", cName(name), num)
+		case asmExpression:
+			text := sym.Val.(asmExpression).Text()
+			fmt.Fprintf(w, "#define %s %s\n", cName(name), asmString(text).CString())
+		case asmText:
+			text := sym.Val.(asmText).Text()
+			fmt.Fprintf(w, "#define %s %s\n", cName(name), asmString(text).CString())
+		}
+	})
+}
+
+// cKeyword returns the C keyword for the kind of structure of v.
+func (v *asmStruc) cKeyword() string {
+	if v.flag == sUnion {
+		return "union"
+	}
+	return "struct"
+}
+
+// cStrucType returns the named structure type that unit refers to, or nil
+// if unit is no structure, or a nested one that only exists as part of its
+// parent.
+func cStrucType(syms *SymMap, unit DataUnit) *asmStruc {
+	struc, ok := unit.(*asmStruc)
+	if !ok || struc.name == "" {
+		return nil
+	}
+	val, _ := syms.Lookup(struc.name)
+	if _, ok := val.(asmStruc); !ok {
+		return nil
+	}
+	return struc
+}
+
+// cMember describes a single member of a C structure, or a single C
+// variable.
+type cMember struct {
+	name  string
+	unit  DataUnit
+	count uint // Number of elements; 0 for non-array members
+	off   uint // Offset of the first byte within its data block
+	size  uint // Number of bytes covered
+	real  bool // Initialized with floating-point numbers?
+}
+
+// cMembers returns the members of the given data block in declaration order.
+// A member spans all bytes up to the next named one, and is turned into an
+// array if it covers more than one element of its unit. Unnamed data becomes
+// a byte array, named with the given prefix followed by its offset.
+func cMembers(l BlobList, union bool, unnamed string) (ret []cMember) {
+	// Nested structures without a name become anonymous members.
+	isMember := func(ptr asmPtr) bool {
+		if ptr.sym == nil || ptr.unit.Width() == 0 {
+			return false
+		}
+		_, nested := ptr.unit.(*asmStruc)
+		return isCIdent(*ptr.sym) || (nested && *ptr.sym == "")
+	}
+	named := func(b Blob) bool {
+		for _, ptr := range b.Ptrs {
+			if isMember(ptr) {
+				return true
+			}
+		}
+		return false
+	}
+	var largest uint
+	for start := 0; start < len(l); {
+		end := start + 1
+		for end < len(l) && !named(l[end]) {
+			end++
+		}
+		size := uint(end - start)
+		if !named(l[start]) {
+			ret = append(ret, cMember{
+				name: fmt.Sprintf("%s%x", unnamed, start), unit: SimpleData(1),
+				count: size, off: uint(start), size: size,
+			})
+		}
+		for _, ptr := range l[start].Ptrs {
+			width := ptr.unit.Width()
+			if !isMember(ptr) {
+				continue
+			}
+			_, real := (*l[start].Data).(asmReal)
+			member := cMember{
+				name: *ptr.sym, unit: ptr.unit, off: uint(start), size: size,
+				real: real,
+			}
+			// Union members are padded to the size of the union, so
+			// their original length is unknown.
+			if union {
+				member.size = width
+			} else if size != width {
+				member.count = size / width
+				if size%width != 0 {
+					member.unit = SimpleData(1)
+					member.count = size
+				}
+			}
+			if width > largest {
+				largest = width
+			}
+			ret = append(ret, member)
+		}
+		start = end
+	}
+	if union && largest < uint(len(l)) {
+		ret = append(ret, cMember{
+			name: "unnamed", unit: SimpleData(1), count: uint(len(l)),
+			size: uint(len(l)),
+		})
+	}
+	return ret
+}
+
+// writeCDecl writes the C declaration of m to w, without a trailing
+// semicolon. Nested structures are defined inline, at the given indentation
+// level.
+func writeCDecl(w io.Writer, syms *SymMap, m cMember, indent int) {
+	var dims string
+	if m.count != 0 {
+		dims = fmt.Sprintf("[%d]", m.count)
+	}
+	switch m.unit.(type) {
+	case *asmStruc:
+		nested := m.unit.(*asmStruc)
+		if struc := cStrucType(syms, nested); struc != nil {
+			fmt.Fprintf(w, "%s %s", struc.cKeyword(), cName(struc.name))
+		} else {
+			fmt.Fprint(w, nested.cKeyword()+" ")
+			nested.writeC(w, syms, indent+1)
+		}
+	default:
+		switch width := m.unit.Width(); {
+		case m.real && width == 4:
+			fmt.Fprint(w, "float")
+		case m.real && width == 8:
+			fmt.Fprint(w, "double")
+		case m.real && width == 10:
+			fmt.Fprint(w, "long double")
+		case width == 1 || width == 2 || width == 4 || width == 8:
+			fmt.Fprintf(w, "uint%d_t", width*8)
+		default:
+			fmt.Fprint(w, "uint8_t")
+			dims += fmt.Sprintf("[%d]", width)
+		}
+	}
+	if m.name != "" {
+		fmt.Fprint(w, " "+cName(m.name))
+	}
+	fmt.Fprint(w, dims)
+}
+
+// writeC writes the body of v as a C structure or union definition to w,
+// starting with the opening brace and ending with the closing one.
+func (v *asmStruc) writeC(w io.Writer, syms *SymMap, indent int) {
+	indentStr := strings.Repeat("\t", indent)
+	fmt.Fprintln(w, "{")
+	for _, member := range cMembers(v.data, v.flag == sUnion, "unnamed_") {
+		fmt.Fprint(w, indentStr+"\t")
+		writeCDecl(w, syms, member, indent)
+		fmt.Fprintln(w, ";")
+	}
+	fmt.Fprint(w, indentStr+"}")
+}
+
+// cValues returns the C initializers of all elements of the given unit in
+// data, or false if data doesn't consist of such elements.
+func cValues(syms *SymMap, data Emittable, unit DataUnit) ([]string, bool) {
+	width := unit.Width()
+	switch data.(type) {
+	case DataArray:
+		var ret []string
+		for _, elm := range data.(DataArray) {
+			vals, ok := cValues(syms, elm, unit)
+			if !ok {
+				return nil, false
+			}
+			ret = append(ret, vals...)
+		}
+		return ret, true
+	case *DUPOperator:
+		dup := data.(*DUPOperator)
+		vals, ok := cValues(syms, dup.data, unit)
+		var ret []string
+		for i := int64(0); ok && i < dup.count.Calc().n; i++ {
+			ret = append(ret, vals...)
+		}
+		return ret, ok
+	case asmInt:
+		if uint(data.Len()) == width {
+			return []string{data.(asmInt).CString()}, true
+		}
+	case CalcToEmitOperator:
+		if uint(data.Len()) == width {
+			return []string{data.(CalcToEmitOperator).Calc.Calc().CString()}, true
+		}
+	case asmReal:
+		if data.(asmReal).raw == nil && data.Len() == width {
+			return []string{data.(asmReal).String()}, true
+		}
+	case asmString:
+		// Strings only survive as such in byte data, or as padding.
+		var ret []string
+		str := data.(asmString)
+		for i := 0; i < len(str); i++ {
+			switch {
+			case str[i] != 0 && width == 1:
+				ret = append(ret, asmInt{n: int64(str[i]), base: 255}.CString())
+			case str[i] != 0:
+				return nil, false
+			case i%int(width) == 0:
+				ret = append(ret, "0")
+			}
+		}
+		return ret, width > 0 && len(str)%int(width) == 0
+	case asmStruc, *asmStruc:
+		var struc asmStruc
+		if ptr, ok := data.(*asmStruc); ok {
+			struc = *ptr
+		} else {
+			struc = data.(asmStruc)
+		}
+		if struc.Width() != width {
+			return nil, false
+		}
+		var inits []string
+		for _, member := range cMembers(struc.data, struc.flag == sUnion, "") {
+			init, ok := cInitializer(syms, struc.data, member)
+			if !ok {
+				return nil, false
+			}
+			inits = append(inits, init)
+			// C can only initialize the first member of a union.
+			if struc.flag == sUnion {
+				break
+			}
+		}
+		return []string{"{ " + strings.Join(inits, ", ") + " }"}, true
+	}
+	return nil, false
+}
+
+// cInitializer returns the C initializer of m within l, or false if its data
+// can't be split into elements of its unit.
+func cInitializer(syms *SymMap, l BlobList, m cMember) (string, bool) {
+	var vals []string
+	end := m.off + m.size
+	str := false
+	for i := m.off; i < end; {
+		data := l[i].Data
+		for i < end && l[i].Data == data {
+			i++
+		}
+		if i < uint(len(l)) && i == end && l[i].Data == data {
+			// The data continues beyond m.
+			return "", false
+		}
+		elms, ok := cValues(syms, *data, m.unit)
+		if !ok {
+			return "", false
+		}
+		vals = append(vals, elms...)
+		if s, ok := (*data).(asmString); ok && len(s) > 1 {
+			str = str || strings.Trim(string(s), "\x00") != ""
+		}
+	}
+	if m.count == 0 {
+		if len(vals) != 1 {
+			return "", false
+		}
+		return vals[0], true
+	} else if uint(len(vals)) != m.count {
+		return "", false
+	} else if str && m.unit.Width() == 1 {
+		bytes := string(l[m.off:end].Emit())
+		return cQuote(strings.TrimRight(bytes, "\x00"), '"'), true
+	}
+	return "{ " + strings.Join(vals, ", ") + " }", true
+}
+
+// cBytes returns the data in l in x86 byte order, as the fallback
+// initializer of declarations that can't be expressed in their unit.
+func cBytes(l BlobList) (ret []byte) {
+	var last *Emittable
+	for _, cur := range l {
+		if cur.Data != last {
+			ret = append(ret, littleEndian(*cur.Data)...)
+			last = cur.Data
+		}
+	}
+	return ret
+}
+
+// littleEndian returns the bytes of data with all integers in little-endian
+// byte order.
+func littleEndian(data Emittable) []byte {
+	switch data.(type) {
+	case asmInt:
+		ret := data.Emit()
+		for i, j := 0, len(ret)-1; i < j; i, j = i+1, j-1 {
+			ret[i], ret[j] = ret[j], ret[i]
+		}
+		return ret
+	case CalcToEmitOperator:
+		return littleEndian(data.(CalcToEmitOperator).Calc.Calc())
+	case *DUPOperator:
+		dup := data.(*DUPOperator)
+		return bytes.Repeat(littleEndian(dup.data), int(dup.count.Calc().n))
+	case DataArray:
+		var ret []byte
+		for _, elm := range data.(DataArray) {
+			ret = append(ret, littleEndian(elm)...)
+		}
+		return ret
+	case asmStruc:
+		return cBytes(data.(asmStruc).data)
+	case *asmStruc:
+		return cBytes(data.(*asmStruc).data)
+	}
+	return data.Emit()
+}
+
+// writeCVariables writes a C variable definition for every declaration in the
+// given data block to w. Declarations whose data can't be expressed in their
+// unit become byte arrays, and uninitialized ones have no initializer.
+func writeCVariables(w io.Writer, syms *SymMap, l BlobList, unnamed string) {
+	data := cBytes(l)
+	for _, m := range cMembers(l, false, unnamed) {
+		if l[m.off : m.off+m.size].Uninitialized() {
+			writeCDecl(w, syms, m, 0)
+			fmt.Fprintln(w, ";")
+			continue
+		}
+		init, ok := cInitializer(syms, l, m)
+		if !ok {
+			m.unit = SimpleData(1)
+			m.count = m.size
+			m.real = false
+			var vals []string
+			for _, b := range data[m.off : m.off+m.size] {
+				vals = append(vals, fmt.Sprintf("0x%02x", b))
+			}
+			init = "{ " + strings.Join(vals, ", ") + " }"
+		}
+		writeCDecl(w, syms, m, 0)
+		fmt.Fprintf(w, " = %s;\n", init)
+	}
+}
+
+// EmitC writes a C declaration of every structure and union in syms to w,
+// followed by a definition of every variable in all segments. The
+// declarations are sorted alphabetically, except that every structure comes
+// after the ones it contains. Variables are ordered by segment name, chunk,
+// and offset. Since assembly data has no alignment of its own, everything is
+// wrapped in a 1-byte packing pragma.
+func EmitC(w io.Writer, syms *SymMap) {
+	fmt.Fprintln(w, "#include <stdint.h>")
+	fmt.Fprintln(w, "\n#pragma pack(push, 1)")
+	emitted := make(map[string]bool)
+	var emitStruc func(struc *asmStruc)
+	// Emits all named structures used within v, including those used by
+	// its nested ones.
+	var emitDeps func(v *asmStruc)
+	emitDeps = func(v *asmStruc) {
+		for _, member := range cMembers(v.data, v.flag == sUnion, "") {
+			if struc := cStrucType(syms, member.unit); struc != nil {
+				emitStruc(struc)
+			} else if nested, ok := member.unit.(*asmStruc); ok {
+				emitDeps(nested)
+			}
+		}
+	}
+	emitStruc = func(struc *asmStruc) {
+		if emitted[struc.name] {
+			return
+		}
+		emitted[struc.name] = true
+		emitDeps(struc)
+		fmt.Fprintf(w, "\n%s %s ", struc.cKeyword(), cName(struc.name))
+		struc.writeC(w, syms, 0)
+		fmt.Fprintln(w, ";")
+	}
+	syms.Each(func(name string, sym Symbol) {
+		if struc, ok := sym.Val.(asmStruc); ok && isCIdent(name) {
+			emitStruc(&struc)
+		}
+	})
+	syms.Each(func(name string, sym Symbol) {
+		seg, ok := sym.Val.(*asmSegment)
+		if !ok {
+			return
+		}
+		for c, chunk := range seg.chunks {
+			fmt.Fprintf(w, "\n/* %s, chunk %d */\n", name, c)
+			unnamed := fmt.Sprintf("unnamed_%s_%d_", name, c)
+			writeCVariables(w, syms, chunk, unnamed)
+		}
+	})
+	fmt.Fprintln(w, "\n#pragma pack(pop)")
+}
+
+// EmitCFunctions writes a C function skeleton for every procedure in procs to
+// w, with parameters for their arguments and declarations of their local
+// variables. The body of each function is left as a comment.
+func EmitCFunctions(w io.Writer, syms *SymMap, procs []asmProc) {
+	decl := func(v procVar) cMember {
+		m := cMember{name: v.name, unit: v.unit}
+		if v.count != 1 {
+			m.count = v.count
+		}
+		return m
+	}
+	for _, proc := range procs {
+		if !isCIdent(proc.name) {
+			continue
+		}
+		fmt.Fprintf(w, "\nvoid %s(", cName(proc.name))
+		for i, arg := range proc.args {
+			if i > 0 {
+				fmt.Fprint(w, ", ")
+			}
+			writeCDecl(w, syms, decl(arg), 0)
+		}
+		if len(proc.args) == 0 {
+			fmt.Fprint(w, "void")
+		}
+		fmt.Fprintln(w, ")\n{")
+		for _, local := range proc.locals {
+			fmt.Fprint(w, "\t")
+			writeCDecl(w, syms, decl(local), 0)
+			fmt.Fprintln(w, ";")
+		}
+		if len(proc.uses) > 0 {
+			fmt.Fprintf(w, "\t/* USES %s */\n", strings.Join(proc.uses, ", "))
+		}
+		fmt.Fprintf(w, "\t/* %d instructions */\n}\n", proc.instructions)
+	}
+}
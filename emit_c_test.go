@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// emitC parses src and returns its C output.
+func emitC(t *testing.T, src string) string {
+	t.Helper()
+	p, err := parseString(t, src, ParseOptions{})
+	checkErrors(t, err, ESError, "")
+	var buf bytes.Buffer
+	EmitC(&buf, &p.syms)
+	return buf.String()
+}
+
+func TestEmitCStructs(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{
+			"INNER STRUC\na DB ?\nb DD ?\nINNER ENDS\n",
+			[]string{
+				"#pragma pack(push, 1)",
+				"struct INNER {\n\tuint8_t a;\n\tuint32_t b;\n};",
+				"#pragma pack(pop)",
+			},
+		}, {
+			"I STRUC\nx DW ?\nI ENDS\nO STRUC\nc DB ?\nin I <>\nO ENDS\n",
+			[]string{
+				"struct I {\n\tuint16_t x;\n};",
+				"struct O {\n\tuint8_t c;\n\tstruct I in;\n};",
+			},
+		}, {
+			"U UNION\nb DB ?\nw DW ?\nU ENDS\n",
+			[]string{"union U {\n\tuint8_t b;\n\tuint16_t w;\n};"},
+		},
+	}
+	for _, test := range tests {
+		checkOutput(t, emitC(t, test.src), test.want)
+	}
+}
+
+func TestEmitCVariables(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{"d segment\nint dd 5\nd ends\n", []string{"uint32_t int_ = 5;"}},
+		{"d segment\nmix db 1\ndw 2\nd ends\n", []string{"uint8_t mix[3] = { 0x01, 0x02, 0x00 };"}},
+		{
+			"d segment\nw dw 1234h, 5\nmsg db 'hi', 0\nd ends\n",
+			[]string{"uint16_t w[2] = { 0x1234, 5 };", `uint8_t msg[3] = "hi";`},
+		},
+		{
+			"double STRUC\nchar DW ?\ndouble ENDS\nd segment\nv double <1>\nd ends\n",
+			[]string{"struct double_ {\n\tuint16_t char_;\n};", "struct double_ v = { 1 };"},
+		},
+	}
+	for _, test := range tests {
+		checkOutput(t, emitC(t, test.src), test.want)
+	}
+}
+
+func TestEmitCFunctions(t *testing.T) {
+	src := "c segment\n" +
+		"add proc\narg a:word, b:word\nlocal sum:dword\nuses si\nmov ax, a\nadd ax, b\nret\nadd endp\n" +
+		"nop_ proc\nret\nnop_ endp\n" +
+		"c ends\n"
+	p, err := parseString(t, src, ParseOptions{Syntax: "TASM"})
+	checkErrors(t, err, ESWarning, "")
+	var buf bytes.Buffer
+	EmitCFunctions(&buf, &p.syms, p.procs)
+	checkOutput(t, buf.String(), []string{
+		"void add(uint16_t a, uint16_t b)\n{\n\tuint32_t sum;\n\t/* USES si */\n\t/* 3 instructions */\n}\n",
+		"void nop_(void)\n{\n\t/* 1 instructions */\n}\n",
+	})
+}
+
+func TestEmitCDefines(t *testing.T) {
+	src := "FLAG equ 10h\nPERM = 755o\nBITS equ 101b\nNEG = -5\nCHR equ 'A'\n" +
+		"DEC = 42\nMSG equ <hello>\n"
+	p, err := parseString(t, src, ParseOptions{})
+	checkErrors(t, err, ESWarning, "")
+	var buf bytes.Buffer
+	EmitCDefines(&buf, &p.syms)
+	checkOutput(t, buf.String(), []string{
+		"#define BITS 0x5\n",
+		"#define CHR 'A'\n",
+		"#define DEC 42\n",
+		"#define FLAG 0x10\n",
+		"#define MSG \"hello\"\n",
+		"#define NEG (-5)\n",
+		"#define PERM 0755\n",
+	})
+}
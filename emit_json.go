@@ -0,0 +1,50 @@
+// JSON output of the parsed instruction stream.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+func (t itemType) MarshalJSON() ([]byte, error) {
+	switch t {
+	case itemError:
+		return json.Marshal("error")
+	case itemLabel:
+		return json.Marshal("label")
+	case itemInstruction:
+		return json.Marshal("instruction")
+	}
+	return nil, fmt.Errorf("unknown item type: %d", int(t))
+}
+
+// MarshalJSON flattens p to a "file:line" string, using EOF as the line
+// number for positions at the end of a file.
+func (p SourcePos) MarshalJSON() ([]byte, error) {
+	if p.line == 0 {
+		return json.Marshal(*p.filename + ":EOF")
+	}
+	return json.Marshal(fmt.Sprintf("%s:%d", *p.filename, p.line))
+}
+
+func (it item) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Pos       ItemPos    `json:"pos"`
+		Typ       itemType   `json:"typ"`
+		Sym       string     `json:"sym,omitempty"`
+		Val       string     `json:"val"`
+		Params    itemParams `json:"params,omitempty"`
+		Generated bool       `json:"generated,omitempty"`
+	}{it.pos, it.typ, it.sym, it.val, it.params, it.generated})
+}
+
+// EmitJSON writes the given instructions to w as a JSON array. Positions
+// list the code position of the item first, followed by the macros it came
+// from.
+func EmitJSON(w io.Writer, instructions []item) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(instructions)
+}
@@ -0,0 +1,87 @@
+// Memory layout output.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// layoutUnit returns a description of a data unit for the layout tree.
+func layoutUnit(unit DataUnit) string {
+	switch unit.(type) {
+	case SimpleData:
+		return fmt.Sprintf("%d bytes", unit.Width())
+	}
+	return unit.Name()
+}
+
+// DumpLayout lists all symbols in l together with their offsets and the size
+// of the arrays they point to, indented with the given number of tabs. An
+// array starts at a named blob and ends right before the next named one.
+func (l BlobList) DumpLayout(indent int) (ret string) {
+	offsetDigits := 0
+	for listlen := len(l); listlen > 0; listlen /= 16 {
+		offsetDigits++
+	}
+	indentStr := strings.Repeat("\t", indent)
+
+	isNamed := func(ptr asmPtr) bool {
+		return ptr.sym != nil && *ptr.sym != ""
+	}
+	named := func(b Blob) bool {
+		for _, ptr := range b.Ptrs {
+			if isNamed(ptr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for start := 0; start < len(l); {
+		end := start + 1
+		for end < len(l) && !named(l[end]) {
+			end++
+		}
+		size := uint(end - start)
+		offset := fmt.Sprintf("%s• 0%0*xh ", indentStr, offsetDigits, start)
+		uninit := ""
+		if l[start:end].Uninitialized() {
+			uninit = ", uninitialized"
+		}
+		if !named(l[start]) {
+			ret += fmt.Sprintf("%s(unnamed): %d bytes%s\n", offset, size, uninit)
+		}
+		for _, ptr := range l[start].Ptrs {
+			if !isNamed(ptr) {
+				continue
+			}
+			ret += fmt.Sprintf("%s%s: %d bytes", offset, *ptr.sym, size)
+			if width := ptr.unit.Width(); width > 0 {
+				ret += fmt.Sprintf(
+					" (%d × %s)", size/width, layoutUnit(ptr.unit),
+				)
+			}
+			ret += uninit + "\n"
+		}
+		start = end
+	}
+	return ret
+}
+
+// EmitLayout writes a tree of all segments in syms, their data chunks, and
+// the symbols within each chunk to w, in alphabetical order of the segments.
+func EmitLayout(w io.Writer, syms *SymMap) {
+	syms.Each(func(name string, sym Symbol) {
+		seg, ok := sym.Val.(*asmSegment)
+		if !ok {
+			return
+		}
+		fmt.Fprintf(w, "%s: %s\n", name, seg)
+		for c, chunk := range seg.chunks {
+			fmt.Fprintf(w, "\t• chunk %d: %d bytes\n", c, len(chunk))
+			fmt.Fprint(w, chunk.DumpLayout(2))
+		}
+	})
+}
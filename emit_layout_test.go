@@ -0,0 +1,12 @@
+package main
+
+import (
+	"io"
+	"testing"
+)
+
+func TestEmitLayout(t *testing.T) {
+	checkGolden(t, "layout", func(w io.Writer, p *parser) {
+		EmitLayout(w, &p.syms)
+	})
+}
@@ -0,0 +1,24 @@
+// Linker map output.
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// EmitMap writes the decorated name of every public and external symbol in
+// syms to w, together with its value, in alphabetical order.
+func EmitMap(w io.Writer, syms *SymMap) {
+	syms.Each(func(name string, sym Symbol) {
+		external := false
+		switch sym.Val.(type) {
+		case asmDataPtr:
+			external = sym.Val.(asmDataPtr).external
+		}
+		if !sym.Public && !external {
+			return
+		}
+		fmt.Fprintf(w, "%s = %s\n", syms.Internals.Decorate(name), sym.Val)
+	})
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEmitMapDecoration(t *testing.T) {
+	tests := []struct {
+		model string
+		want  []string
+	}{
+		{".model small", []string{"EXT = ", "FOO = "}},
+		{".model small, c", []string{"_EXT = ", "_FOO = "}},
+		{".model small, stdcall", []string{"_EXT = ", "_FOO = "}},
+		{".model small, pascal", []string{"EXT = ", "FOO = "}},
+		{".model small, syscall", []string{"EXT = ", "FOO = "}},
+	}
+	for _, test := range tests {
+		src := test.model + "\npublic foo\nextrn ext:word\n.data\nfoo dw 1\nbar dw 2\nend\n"
+		p, err := parseString(t, src, ParseOptions{})
+		checkErrors(t, err, ESWarning, "")
+		var buf bytes.Buffer
+		EmitMap(&buf, &p.syms)
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if len(lines) != len(test.want) {
+			t.Errorf("%s: got %d symbols, want %d:\n%s", test.model, len(lines), len(test.want), buf.String())
+			continue
+		}
+		for i, line := range lines {
+			if !strings.HasPrefix(line, test.want[i]) {
+				t.Errorf("%s: got %q, want prefix %q", test.model, line, test.want[i])
+			}
+		}
+	}
+}
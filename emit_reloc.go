@@ -0,0 +1,24 @@
+// Relocation output.
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// EmitRelocs writes every address stored in the data of all segments in syms
+// to w, together with the symbol it refers to.
+func EmitRelocs(w io.Writer, syms *SymMap) {
+	syms.Each(func(name string, sym Symbol) {
+		switch sym.Val.(type) {
+		case *asmSegment:
+			seg := sym.Val.(*asmSegment)
+			for _, reloc := range seg.relocs {
+				fmt.Fprintf(w, "%s:%d:%0*xh\t%s\n",
+					seg.name, reloc.chunk, seg.wordsize*2, reloc.off, reloc,
+				)
+			}
+		}
+	})
+}
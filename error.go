@@ -3,7 +3,11 @@
 
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
 
 type ErrorSeverity int
 
@@ -33,6 +37,8 @@ type Error struct {
 	s   string
 	pos ItemPos // Optionally overrides the default position used for logging.
 	sev ErrorSeverity
+	// Name of the symbol if this is an "unknown symbol" error.
+	unresolved string
 }
 
 type ErrorList []Error
@@ -83,6 +89,113 @@ func ErrorListFAt(pos ItemPos, sev ErrorSeverity, format string, a ...interface{
 	return ErrorList{Error{s: fmt.Sprintf(format, a...), pos: pos, sev: sev}}
 }
 
+// ErrorListUnresolved creates a new error list with an "unknown symbol" error
+// for the given symbol name.
+func ErrorListUnresolved(name string) ErrorList {
+	ret := ErrorListF(ESError, "unknown symbol: %s", name)
+	ret[0].unresolved = name
+	return ret
+}
+
+// Unresolved returns whether e contains an "unknown symbol" error.
+func (e ErrorList) Unresolved() bool {
+	for _, err := range e {
+		if err.unresolved != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// GroupUnresolved removes all "unknown symbol" errors from e, and appends a
+// single error at the given position for every unknown symbol instead,
+// listing all of its use sites.
+func (e ErrorList) GroupUnresolved(pos ItemPos) (ret ErrorList) {
+	var names []string
+	sites := make(map[string][]ItemPos)
+	for _, err := range e {
+		if err.unresolved == "" {
+			ret = append(ret, err)
+			continue
+		}
+		if _, ok := sites[err.unresolved]; !ok {
+			names = append(names, err.unresolved)
+		}
+		sites[err.unresolved] = append(sites[err.unresolved], err.pos)
+	}
+	for _, name := range names {
+		str := ""
+		for _, site := range sites[name] {
+			str += "\n\t" + strings.TrimSpace(site.String())
+		}
+		ret = ret.AddFAt(pos, ESError, "unknown symbol: %s, used at:%s", name, str)
+	}
+	return ret
+}
+
+// posLess returns whether a comes before b in the source code. Positions
+// inside macros are ordered by their invocation first.
+func posLess(a, b ItemPos) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if *a[i].filename != *b[i].filename {
+			return *a[i].filename < *b[i].filename
+		}
+		// Line 0 is the end of the file.
+		lineA, lineB := a[i].line-1, b[i].line-1
+		if lineA != lineB {
+			return lineA < lineB
+		}
+	}
+	return len(a) < len(b)
+}
+
+// Collapse returns the errors in e sorted by their code position, with all
+// identical errors at the same position merged into one that lists the
+// number of occurrences. Fatal errors are kept at the end.
+func (e ErrorList) Collapse() (ret ErrorList) {
+	var fatal ErrorList
+	var counts []int
+	seen := make(map[string]int)
+	sorted := make(ErrorList, 0, len(e))
+	for _, err := range e {
+		if err.sev >= ESFatal {
+			fatal = append(fatal, err)
+		} else {
+			sorted = append(sorted, err)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return posLess(sorted[i].pos, sorted[j].pos)
+	})
+	for _, err := range sorted {
+		key := err.sev.String() + err.pos.String() + err.s
+		if i, ok := seen[key]; ok {
+			counts[i]++
+			continue
+		}
+		seen[key] = len(ret)
+		ret = append(ret, err)
+		counts = append(counts, 1)
+	}
+	for i, count := range counts {
+		if count > 1 {
+			ret[i].s += fmt.Sprintf(" (%d occurrences)", count)
+		}
+	}
+	return append(ret, fatal...)
+}
+
+// Count returns the number of errors inside e with at least the given
+// severity.
+func (e ErrorList) Count(sev ErrorSeverity) (ret int) {
+	for _, err := range e {
+		if err.sev >= sev {
+			ret++
+		}
+	}
+	return ret
+}
+
 // Severity returns the highest severity value inside e, or ESNone if e is
 // empty.
 func (e ErrorList) Severity() ErrorSeverity {
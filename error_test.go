@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDeferUnresolved(t *testing.T) {
+	src := "d segment\ndw foo\ndw foo + 1\ndw bar\nfoo2 dw 0\nd ends\n"
+	count := func(err ErrorList, substr string) (ret int) {
+		for _, e := range err {
+			if strings.Contains(e.s, substr) {
+				ret++
+			}
+		}
+		return ret
+	}
+
+	_, err := parseString(t, src, ParseOptions{})
+	if n := count(err, "unknown symbol: FOO"); n != 2 {
+		t.Errorf("got %d errors for FOO, want 2:\n%s", n, errorsString(err))
+	}
+
+	_, err = parseString(t, src, ParseOptions{DeferUnresolved: true})
+	if n := count(err, "unknown symbol: FOO"); n != 1 {
+		t.Fatalf("got %d errors for FOO, want 1:\n%s", n, errorsString(err))
+	}
+	e := findError(err, ESError, "unknown symbol: FOO")
+	for _, site := range []string{"test.asm(2)", "test.asm(3)"} {
+		if !strings.Contains(e.s, site) {
+			t.Errorf("use site %s missing: %s", site, e.s)
+		}
+	}
+	if strings.Contains(e.s, "test.asm(4)") {
+		t.Errorf("use site of BAR listed for FOO: %s", e.s)
+	}
+	checkErrors(t, err, ESError, "unknown symbol: BAR, used at:")
+}
+
+func TestSeverity(t *testing.T) {
+	var nilList ErrorList
+	tests := []struct {
+		err  ErrorList
+		want ErrorSeverity
+	}{
+		{nil, ESNone},
+		{ErrorList{}, ESNone},
+		{nilList.AddL(nil), ESNone},
+		{ErrorListF(ESDebug, "a"), ESDebug},
+		{ErrorListF(ESWarning, "a").AddF(ESDebug, "b"), ESWarning},
+		{ErrorListF(ESWarning, "a").AddF(ESError, "b").AddF(ESDebug, "c"), ESError},
+		{nilList.AddL(ErrorListF(ESFatal, "a")), ESFatal},
+		{ErrorListUnresolved("x"), ESError},
+	}
+	for i, test := range tests {
+		if got := test.err.Severity(); got != test.want {
+			t.Errorf("%d: got severity %d, want %d", i, got, test.want)
+		}
+	}
+}
@@ -17,6 +17,30 @@ var shuntDelim = append(charGroup{
 var macroDelim = append(charGroup{','}, shuntDelim...)
 var segmentDelim = append(charGroup{'\'', '"'}, whitespace...)
 
+// isSymbolChar returns whether b can appear within a symbol name.
+func isSymbolChar(b byte) bool {
+	return (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') ||
+		(b >= '0' && b <= '9') || b == '_' || b == '@' || b == '$' || b == '?'
+}
+
+// isSymbol returns whether s is a valid symbol name. Like in MASM's
+// OPTION DOTNAME mode, the first character can also be a dot.
+func isSymbol(s string) bool {
+	if len(s) == 0 || (s[0] >= '0' && s[0] <= '9') {
+		return false
+	}
+	start := 0
+	if s[0] == '.' {
+		start++
+	}
+	for i := start; i < len(s); i++ {
+		if !isSymbolChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
 func (g charGroup) matches(b byte) bool {
 	for _, v := range g {
 		if v == b {
@@ -108,6 +132,21 @@ func (s *lexStream) nextToken(delim charGroup) string {
 	return ret
 }
 
+// nextSymbolToken works like nextToken, but also splits the returned string
+// at every boundary between symbol characters and other punctuation.
+func (s *lexStream) nextSymbolToken(delim charGroup) string {
+	ret := s.nextToken(delim)
+	n := 0
+	for n < len(ret) && isSymbolChar(ret[n]) {
+		n++
+	}
+	if n == 0 {
+		n = 1
+	}
+	s.c -= len(ret) - n
+	return ret[:n]
+}
+
 // nextSegmentParam returns the next token delimited by either whitespace
 // or quotes.
 func (s *lexStream) nextSegmentParam() (ret string, err ErrorList) {
@@ -160,11 +199,20 @@ func (s *lexStream) nextNestedString(delim charGroup) string {
 		}
 		leavecond := false
 		if nest != nil {
+			// ! escapes the next character in <text strings>.
+			if b == '!' && nest.delim == '>' && breakcond() {
+				s.next()
+				continue
+			}
 			leavecond = (b == nest.delim)
 		}
+		// Inside parentheses, angle brackets are relational operators.
+		inParens := nest != nil && nest.delim == ')'
 		if leavecond {
 			nest = nest.prev
 			quote = 0
+		} else if b == '<' && inParens {
+			continue
 		} else if ll := nestChars[b]; ll != 0 && quote == 0 {
 			if b == '\'' || b == '"' {
 				quote = b
@@ -13,12 +13,18 @@ type printlnFn func(*log.Logger, ...interface{})
 
 var codeLogger = log.New(os.Stderr, "", 0)
 
-// Print pretty-prints the given error list.
+// Minimum severity of errors to be printed. Fatal errors are always printed.
+var logSeverity = ESWarning
+
+// Print pretty-prints all errors in the given list that are at least as
+// severe as logSeverity.
 func (e ErrorList) Print() {
 	for _, err := range e {
 		fn := codeLogger.Println
 		if err.sev == ESFatal {
 			fn = codeLogger.Fatalln
+		} else if err.sev < logSeverity {
+			continue
 		}
 		sevstr := err.sev.String()
 		posstr := strings.Replace(
@@ -5,6 +5,7 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"strings"
 )
 
@@ -31,12 +32,34 @@ const (
 	opGt = "GT"
 	opGe = "GE"
 
+	opULt = "ULT"
+	opULe = "ULE"
+	opUGt = "UGT"
+	opUGe = "UGE"
+
 	opNot = "NOT"
 
+	opHigh     = "HIGH"
+	opLow      = "LOW"
+	opHighWord = "HIGHWORD"
+	opLowWord  = "LOWWORD"
+
 	opParenL = "("
 	opParenR = ")"
 
-	opPtr = "PTR"
+	opBracketL = "["
+	opBracketR = "]"
+
+	opPtr      = "PTR"
+	opOffset   = "OFFSET"
+	opSeg      = "SEG"
+	opSizeOf   = "SIZEOF"
+	opLengthOf = "LENGTHOF"
+	opSize     = "SIZE"
+	opLength   = "LENGTH"
+	opType     = "TYPE"
+	opMask     = "MASK"
+	opWidth    = "WIDTH"
 
 	opDup = "DUP"
 )
@@ -56,11 +79,228 @@ func (op *shuntOp) String() string {
 	return string(op.id)
 }
 
+// opening returns whether op is an opening parenthesis or bracket.
+func (op *shuntOp) opening() bool {
+	return op.id == opParenL || op.id == opBracketL
+}
+
+// opener returns the ID of the opening counterpart of a closing parenthesis
+// or bracket.
+func (op *shuntOp) opener() OperatorID {
+	if op.id == opBracketR {
+		return opBracketL
+	}
+	return opParenL
+}
+
 type shuntOpMap map[string]shuntOp
 
+// symbolOperator is the function type of operators that don't work on
+// integers, but directly on the symbol following them.
+type symbolOperator func(operand Thingy) (asmInt, ErrorList)
+
+// offsetOf returns the offset of the data pointer in operand.
+func offsetOf(operand Thingy) (asmInt, ErrorList) {
+	switch operand.(type) {
+	case asmDataPtr:
+		// External symbols simply have an offset of 0. Symbols in grouped
+		// segments are relative to the start of the group, as done by
+		// MASM's default of OPTION OFFSET:GROUP.
+		ptr := operand.(asmDataPtr)
+		off := ptr.off
+		if seg, ok := ptr.et.(*asmSegment); ok && seg.group != nil {
+			off += seg.group.Offset(seg)
+		}
+		reloc := &asmReloc{typ: RelocOffset, target: *ptr.ptr.sym}
+		return asmInt{n: int64(off), reloc: reloc, addr: true}, nil
+	}
+	return asmInt{}, ErrorListF(ESError,
+		"OFFSET requires an addressable operand, not %s", operand.Thing(),
+	)
+}
+
+// sizeOf returns the total number of bytes in the type or data declaration
+// in operand.
+func sizeOf(operand Thingy) (asmInt, ErrorList) {
+	switch operand.(type) {
+	case asmInt:
+		// Type names have already been resolved to their size.
+		if operand.(asmInt).ptr == 0 {
+			return operand.(asmInt), nil
+		}
+	case asmStruc:
+		return asmInt{n: int64(operand.(asmStruc).Width())}, nil
+	case asmTypedef:
+		return asmInt{n: int64(operand.(asmTypedef).unit.Width())}, nil
+	case asmDataPtr:
+		return asmInt{n: int64(operand.(asmDataPtr).Size())}, nil
+	}
+	return asmInt{}, ErrorListF(ESError,
+		"SIZEOF requires a type or data label, not %s", operand.Thing(),
+	)
+}
+
+// typeOf returns the number of bytes in a single element of the type or data
+// declaration in operand.
+func typeOf(operand Thingy) (asmInt, ErrorList) {
+	switch operand.(type) {
+	case asmInt:
+		// Type names have already been resolved to their size.
+		if operand.(asmInt).ptr == 0 {
+			return operand.(asmInt), nil
+		}
+	case asmStruc:
+		return asmInt{n: int64(operand.(asmStruc).Width())}, nil
+	case asmTypedef:
+		return asmInt{n: int64(operand.(asmTypedef).unit.Width())}, nil
+	case asmDataPtr:
+		return asmInt{n: int64(operand.(asmDataPtr).Width())}, nil
+	}
+	return asmInt{}, ErrorListF(ESError,
+		"TYPE requires a type or data label, not %s", operand.Thing(),
+	)
+}
+
+// maskOf returns the bit mask of the record or record field in operand.
+func maskOf(operand Thingy) (asmInt, ErrorList) {
+	switch operand.(type) {
+	case asmRecord:
+		return asmInt{n: operand.(asmRecord).Mask(), base: 16}, nil
+	case asmRecordField:
+		return asmInt{n: operand.(asmRecordField).Mask(), base: 16}, nil
+	}
+	return asmInt{}, ErrorListF(ESError,
+		"MASK requires a record or record field, not %s", operand.Thing(),
+	)
+}
+
+// widthOf returns the number of bits in the record or record field in
+// operand.
+func widthOf(operand Thingy) (asmInt, ErrorList) {
+	switch operand.(type) {
+	case asmRecord:
+		return asmInt{n: int64(operand.(asmRecord).Width())}, nil
+	case asmRecordField:
+		return asmInt{n: int64(operand.(asmRecordField).width)}, nil
+	}
+	return asmInt{}, ErrorListF(ESError,
+		"WIDTH requires a record or record field, not %s", operand.Thing(),
+	)
+}
+
+// lengthOf returns the number of elements in the data declaration in operand.
+func lengthOf(operand Thingy) (asmInt, ErrorList) {
+	switch operand.(type) {
+	case asmDataPtr:
+		ptr := operand.(asmDataPtr)
+		if width := ptr.Width(); width != 0 {
+			return asmInt{n: int64(ptr.Size() / width)}, nil
+		}
+		return asmInt{n: 1}, nil
+	}
+	return asmInt{}, ErrorListF(ESError,
+		"LENGTHOF requires a data label, not %s", operand.Thing(),
+	)
+}
+
+// firstLength implements MASM 5's LENGTH, which only counts the elements of
+// a DUP at the start of the data declaration in operand.
+func firstLength(operand Thingy) (asmInt, ErrorList) {
+	switch operand.(type) {
+	case asmDataPtr:
+		return asmInt{n: int64(operand.(asmDataPtr).FirstLength())}, nil
+	}
+	return asmInt{}, ErrorListF(ESError,
+		"LENGTH requires a data label, not %s", operand.Thing(),
+	)
+}
+
+// firstSize implements MASM 5's SIZE, which returns LENGTH * TYPE for data
+// labels, and the same as SIZEOF for types.
+func firstSize(operand Thingy) (asmInt, ErrorList) {
+	switch operand.(type) {
+	case asmDataPtr:
+		ptr := operand.(asmDataPtr)
+		return asmInt{n: int64(ptr.FirstLength() * ptr.Width())}, nil
+	case asmInt, asmStruc, asmTypedef:
+		if ret, err := sizeOf(operand); err == nil {
+			return ret, nil
+		}
+	}
+	return asmInt{}, ErrorListF(ESError,
+		"SIZE requires a type or data label, not %s", operand.Thing(),
+	)
+}
+
+// segOf returns the index of the segment that contains the data pointer in
+// operand, or of operand itself if it is a segment.
+func segOf(operand Thingy) (asmInt, ErrorList) {
+	switch operand.(type) {
+	case *asmSegment:
+		seg := operand.(*asmSegment)
+		reloc := &asmReloc{typ: RelocSegment, target: seg.name}
+		return asmInt{n: int64(seg.index), reloc: reloc}, nil
+	case asmDataPtr:
+		ptr := operand.(asmDataPtr)
+		reloc := &asmReloc{typ: RelocSegment, target: *ptr.ptr.sym}
+		switch ptr.et.(type) {
+		case nil:
+			// Just like their offset, this is resolved by the linker.
+			return asmInt{reloc: reloc}, nil
+		case *asmSegment:
+			seg := ptr.et.(*asmSegment)
+			return asmInt{n: int64(seg.index), reloc: reloc}, nil
+		}
+		return asmInt{}, ErrorListF(ESError,
+			"SEG requires an operand inside a segment, not inside %s",
+			ptr.et.Name(),
+		)
+	}
+	return asmInt{}, ErrorListF(ESError,
+		"SEG requires an addressable operand, not %s", operand.Thing(),
+	)
+}
+
 type shuntStack struct {
 	vals []Thingy
 	unit DataUnit
+	syms *SymMap // Symbol table the operands were taken from
+	// Text equates that were expanded into the expression.
+	texts []textExpansion
+}
+
+// textExpansion records the name and value of an expanded text equate.
+type textExpansion struct {
+	name string
+	text asmExpression
+}
+
+// explainTexts adds an explanation to err for every text equate in texts
+// whose text doesn't evaluate to a number on its own, if err contains an
+// error. Those are the most likely reason for the error. Equates can refer to
+// symbols that are defined later, so unknown symbols only mean that the
+// symbol is never defined.
+func (s *SymMap) explainTexts(pos ItemPos, texts []textExpansion, err ErrorList) ErrorList {
+	if err.Severity() < ESError {
+		return err
+	}
+	for _, t := range texts {
+		_, errText := s.evalInt(pos, t.text.Text())
+		if errText.Severity() < ESError {
+			continue
+		} else if errText.Unresolved() {
+			err = err.AddF(ESError,
+				"%s is a text equate for <%s>, which refers to undefined symbols",
+				t.name, t.text.Text(),
+			)
+		} else {
+			err = err.AddF(ESError,
+				"%s is a text equate for <%s>, which is not a number",
+				t.name, t.text.Text(),
+			)
+		}
+	}
+	return err
 }
 
 func (stack *shuntStack) String() string {
@@ -94,8 +334,45 @@ func b2i(b bool) int64 {
 	return 0
 }
 
+// overflows returns whether applying the operator with the given ID to a and
+// b exceeds the range of a signed 64-bit integer. Unary operators are checked
+// by passing 0 for a.
+func overflows(id OperatorID, a, b int64) bool {
+	switch id {
+	case opPlus:
+		sum := a + b
+		return (a >= 0) == (b >= 0) && (sum >= 0) != (a >= 0)
+	case opMinus:
+		diff := a - b
+		return (a >= 0) != (b >= 0) && (diff >= 0) != (a >= 0)
+	case opMul:
+		if a == 0 || b == 0 {
+			return false
+		}
+		product := a * b
+		return product/b != a || (a == -1 && b == math.MinInt64) ||
+			(b == -1 && a == math.MinInt64)
+	case opDiv:
+		return a == math.MinInt64 && b == -1
+	case opShL:
+		// Shifting into the sign bit is fine, as long as no set bits are
+		// shifted out.
+		if a == 0 {
+			return false
+		} else if b < 0 || b >= 64 {
+			return true
+		}
+		u := uint64(a)
+		return (a<<uint(b))>>uint(b) != a && (u<<uint(b))>>uint(b) != u
+	}
+	return false
+}
+
+// asmTypes maps the names of the built-in data types to their size in bytes,
+// which is also their value in arithmetic expressions. Structure names are
+// treated the same way.
 var asmTypes = map[string]asmInt{
-	"?":     {n: 0},
+	"?":     {n: 0, uninit: true},
 	"BYTE":  {n: 1},
 	"WORD":  {n: 2},
 	"DWORD": {n: 4},
@@ -103,20 +380,43 @@ var asmTypes = map[string]asmInt{
 	"FWORD": {n: 6},
 	"QWORD": {n: 8},
 	"TBYTE": {n: 10},
+	// Real number types
+	"REAL4":  {n: 4},
+	"REAL8":  {n: 8},
+	"REAL10": {n: 10},
 }
 
 var unaryOperators = shuntOpMap{
 	"(":   {opParenL, 1, 0, nil},
 	")":   {opParenR, 1, 0, nil},
+	"[":   {opBracketL, 1, 0, nil},
+	"]":   {opBracketR, 1, 0, nil},
 	"+":   {opPlus, 6, 1, func(a *asmInt) {}},
 	"-":   {opMinus, 6, 1, func(a *asmInt) { a.n = -a.n }},
 	"NOT": {opNot, 11, 1, func(a *asmInt) { a.n = ^a.n }},
+
+	"OFFSET":   {opOffset, 5, 1, symbolOperator(offsetOf)},
+	"SEG":      {opSeg, 5, 1, symbolOperator(segOf)},
+	"SIZEOF":   {opSizeOf, 5, 1, symbolOperator(sizeOf)},
+	"SIZE":     {opSize, 5, 1, symbolOperator(firstSize)},
+	"LENGTHOF": {opLengthOf, 5, 1, symbolOperator(lengthOf)},
+	"LENGTH":   {opLength, 5, 1, symbolOperator(firstLength)},
+	"TYPE":     {opType, 5, 1, symbolOperator(typeOf)},
+	"MASK":     {opMask, 5, 1, symbolOperator(maskOf)},
+	"WIDTH":    {opWidth, 5, 1, symbolOperator(widthOf)},
+
+	"HIGH":     {opHigh, 6, 1, func(a *asmInt) { a.n = (a.n >> 8) & 0xFF }},
+	"LOW":      {opLow, 6, 1, func(a *asmInt) { a.n &= 0xFF }},
+	"HIGHWORD": {opHighWord, 6, 1, func(a *asmInt) { a.n = (a.n >> 16) & 0xFFFF }},
+	"LOWWORD":  {opLowWord, 6, 1, func(a *asmInt) { a.n &= 0xFFFF }},
 }
 
 var binaryOperators = shuntOpMap{
 	"DUP": {opDup, 15, 2, nil},
 	"(":   {opParenL, 1, 0, nil},
 	")":   {opParenR, 1, 0, nil},
+	"[":   {opBracketL, 1, 0, nil},
+	"]":   {opBracketR, 1, 0, nil},
 	"PTR": {opPtr, 11, 2, func(a, b *asmInt) {
 		a.ptr = uint64(a.n)
 		a.n = b.n
@@ -135,12 +435,36 @@ var binaryOperators = shuntOpMap{
 	"LE":  {opLe, 10, 2, func(a, b *asmInt) { a.n = b2i(a.n <= b.n) }},
 	"GT":  {opGt, 10, 2, func(a, b *asmInt) { a.n = b2i(a.n > b.n) }},
 	"GE":  {opGe, 10, 2, func(a, b *asmInt) { a.n = b2i(a.n >= b.n) }},
+	// The relational operators above compare their operands as signed
+	// 64-bit numbers, which is why NOT 0 is less than 0. These variants
+	// compare them as unsigned numbers instead.
+	"ULT": {opULt, 10, 2, func(a, b *asmInt) { a.n = b2i(uint64(a.n) < uint64(b.n)) }},
+	"ULE": {opULe, 10, 2, func(a, b *asmInt) { a.n = b2i(uint64(a.n) <= uint64(b.n)) }},
+	"UGT": {opUGt, 10, 2, func(a, b *asmInt) { a.n = b2i(uint64(a.n) > uint64(b.n)) }},
+	"UGE": {opUGe, 10, 2, func(a, b *asmInt) { a.n = b2i(uint64(a.n) >= uint64(b.n)) }},
 	"AND": {opAnd, 12, 2, func(a, b *asmInt) { a.n &= b.n }},
 	"OR":  {opOr, 13, 2, func(a, b *asmInt) { a.n |= b.n }},
 	"|":   {opOr, 13, 2, func(a, b *asmInt) { a.n |= b.n }},
 	"XOR": {opXor, 13, 2, func(a, b *asmInt) { a.n ^= b.n }},
 }
 
+// indexOperator adds the expression in brackets, or the offset of a
+// structure member, to the operand before it. Binds tighter than any other
+// operator.
+var indexOperator = shuntOp{opPlus, 2, 2, binaryOperators["+"].function}
+
+// memberOperator is the dot operator, followed by the path of the structure
+// member to access within the address before it.
+type memberOperator string
+
+func (m memberOperator) Thing() string {
+	return "structure member access"
+}
+
+func (m memberOperator) String() string {
+	return "." + string(m)
+}
+
 type shuntConcatenator struct{}
 
 func (c shuntConcatenator) Thing() string {
@@ -316,6 +640,15 @@ func (op BinaryOperator) String() string {
 func (op BinaryOperator) Calc() asmInt {
 	a, b := op.Operands[0].Calc(), op.Operands[1].Calc()
 	op.Function(&a, &b)
+	a.uninit = false
+	if a.reloc == nil && op.ID == opPlus {
+		a.reloc = b.reloc
+	} else if a.reloc != nil && b.reloc != nil && op.ID == opMinus {
+		// The distance between two addresses is a plain number.
+		// TODO: Only if both are in the same segment.
+		a.reloc = nil
+	}
+	a.addr = a.addr || b.addr
 	return a
 }
 
@@ -326,6 +659,17 @@ func (op UnaryOperator) String() string {
 func (op UnaryOperator) Calc() asmInt {
 	a := op.Operand.Calc()
 	op.Function(&a)
+	a.uninit = false
+	if a.reloc != nil && a.reloc.typ == RelocOffset {
+		reloc := *a.reloc
+		switch op.ID {
+		case opLow:
+			reloc.typ = RelocLow
+		case opHigh:
+			reloc.typ = RelocHigh
+		}
+		a.reloc = &reloc
+	}
 	return a
 }
 
@@ -333,7 +677,17 @@ func (op UnaryOperator) Calc() asmInt {
 // in opSet are identified as such.
 func (s *SymMap) nextShuntToken(stream *lexStream, opSet *shuntOpMap) (ret Thingy, err ErrorList) {
 	token := stream.nextToken(shuntDelim)
-	if isAsmInt(token) {
+	if isAsmReal(token + "0") {
+		// Signed exponents.
+		last := token[len(token)-1]
+		if sign := stream.peek(); (last == 'e' || last == 'E') &&
+			(sign == '+' || sign == '-') {
+			token += string(stream.next()) + stream.nextString(shuntDelim)
+		}
+	}
+	if isAsmReal(token) {
+		return newAsmReal(token)
+	} else if isAsmInt(token) {
 		return newAsmInt(token)
 	} else if len(token) == 1 {
 		if quote := token[0]; quotes.matches(quote) {
@@ -351,8 +705,31 @@ func (s *SymMap) nextShuntToken(stream *lexStream, opSet *shuntOpMap) (ret Thing
 	tokenUpper := strings.ToUpper(token)
 	if typ, ok := asmTypes[tokenUpper]; ok {
 		return typ, err
-	} else if nextOp, ok := (*opSet)[tokenUpper]; ok {
+	} else if s.Internals != nil {
+		wordsize := s.Internals.SegmentWordSize()
+		if width := s.Internals.PtrWidth(tokenUpper, wordsize); width != 0 {
+			return asmInt{n: int64(width)}, err
+		}
+	}
+	if nextOp, ok := (*opSet)[tokenUpper]; ok {
 		return &nextOp, err
+	} else if i := strings.IndexByte(token, '.'); i == 0 && len(token) > 1 &&
+		opSet == &binaryOperators {
+		return memberOperator(token[1:]), err
+	} else if i > 0 {
+		if field, errField := s.recordField(token[:i], token[i+1:]); field != nil {
+			return field, err.AddL(errField)
+		}
+		member, errMember := s.structMember(token[:i], token[i+1:])
+		if member != nil || errMember.Severity() >= ESError {
+			return member, err.AddL(errMember)
+		} else if val, errToken := s.Lookup(token); val != nil {
+			return val, err.AddL(errToken)
+		}
+		// Member names are never resolved as standalone symbols, so an
+		// unknown base is the actual problem.
+		_, errBase := s.Get(token[:i])
+		return nil, err.AddL(errBase)
 	}
 	return s.Get(token)
 }
@@ -362,23 +739,23 @@ func (s *SymMap) nextShuntToken(stream *lexStream, opSet *shuntOpMap) (ret Thing
 // operators.
 func (retStack *shuntStack) pushOp(opStack *shuntStack, newOp *shuntOp) (*shuntOpMap, ErrorList) {
 	switch newOp.id {
-	case opParenR:
+	case opParenR, opBracketR:
 		var err ErrorList
 		top, _ := opStack.pop()
-		for top != nil && top.(*shuntOp).id != opParenL {
+		for top != nil && !top.(*shuntOp).opening() {
 			retStack.push(top)
 			top, _ = opStack.pop()
 		}
-		if top == nil {
+		if top == nil || top.(*shuntOp).id != newOp.opener() {
 			err = ErrorListF(ESError, "mismatched parentheses")
 		}
 		return &binaryOperators, err
-	case opParenL:
+	case opParenL, opBracketL:
 		opStack.push(newOp)
 	default:
 		for top := opStack.peek(); top != nil; top = opStack.peek() {
 			op := top.(*shuntOp)
-			if op.id == opParenL || newOp.precedence <= op.precedence {
+			if op.opening() || newOp.precedence <= op.precedence {
 				break
 			}
 			retStack.push(op)
@@ -398,6 +775,12 @@ type shuntState struct {
 	// Data type of the currently evaluated value, or nil if the end of the
 	// expression has been reached.
 	curUnit DataUnit
+	// Structure type of the last label in the expression, used to resolve
+	// member accesses after arbitrary address expressions.
+	struc *asmStruc
+	// Structure type of the last TYPE PTR cast, which takes precedence over
+	// struc for the next member access.
+	cast *asmStruc
 }
 
 func (s *shuntState) nextStrucElm() DataUnit {
@@ -461,7 +844,14 @@ func (s *SymMap) shuntNext(state *shuntState, stream *lexStream) (bool, ErrorLis
 		if len(state.structs) > 0 {
 			state.curUnit = state.nextStrucElm()
 			if state.curUnit == nil {
-				return tokenErr("too many elements in structure initializer")
+				// Skip everything up to the closing bracket of this
+				// instance, which then finishes it as usual.
+				struc := state.structs[len(state.structs)-1].Type
+				excess := stream.nextNestedString(charGroup{'>'})
+				return true, err.AddF(ESWarning,
+					"ignoring excess initializers for structure %s: %s",
+					struc.Name(), excess,
+				)
 			}
 			return true, err
 		}
@@ -481,15 +871,50 @@ func (s *SymMap) shuntNext(state *shuntState, stream *lexStream) (bool, ErrorLis
 		state.opSet = &binaryOperators
 	case asmString:
 		if wordsize > 1 {
-			var errInt ErrorList
-			token, errInt = token.(asmString).Int(wordsize)
+			integer, errInt := token.(asmString).Int(wordsize)
+			integer.wordsize = uint8(wordsize)
+			token = integer
 			err = err.AddL(errInt)
 		}
 		state.retStack.push(token)
 		state.opSet = &binaryOperators
+	case asmReal:
+		real := token.(asmReal)
+		real.wordsize = uint8(wordsize)
+		state.retStack.push(real)
+		state.opSet = &binaryOperators
 	case *shuntOp:
 		var errOp ErrorList
 		op := token.(*shuntOp)
+		if fn, ok := op.function.(symbolOperator); ok {
+			stream.ignore(whitespace)
+			if c := stream.peek(); c == eof || c == ',' || c == ')' {
+				return false, err.AddF(ESError, "%s requires an operand", op.id)
+			}
+			operand, errOperand := s.nextShuntToken(stream, &shuntOpMap{})
+			err = err.AddL(errOperand)
+			if errOperand.Severity() >= ESError {
+				return false, err
+			}
+			integer, errFn := fn(operand)
+			err = err.AddL(errFn)
+			if errFn.Severity() >= ESError {
+				return false, err
+			} else if integer.reloc != nil {
+				integer.reloc.target = s.ToSymCase(integer.reloc.target)
+			}
+			if op.id == opOffset {
+				state.struc, _ = operand.(asmDataPtr).ptr.unit.(*asmStruc)
+			}
+			integer.wordsize = uint8(wordsize)
+			state.retStack.push(integer)
+			state.opSet = &binaryOperators
+			return true, err
+		}
+		if op.id == opBracketL && state.opSet == &binaryOperators {
+			// a[b] is a + b.
+			state.retStack.pushOp(&state.opStack, &indexOperator)
+		}
 		state.opSet, errOp = state.retStack.pushOp(&state.opStack, op)
 		err = err.AddL(errOp)
 
@@ -517,9 +942,56 @@ func (s *SymMap) shuntNext(state *shuntState, stream *lexStream) (bool, ErrorLis
 			state.retStack.push(array)
 			state.curUnit = nil
 		}
+	case asmStruc:
+		struc := token.(asmStruc)
+		integer := asmInt{n: int64(struc.Width())}
+		integer.wordsize = uint8(wordsize)
+		state.retStack.push(integer)
+		state.opSet = &binaryOperators
+		if next := stream.peekUntil(shuntDelim); strings.EqualFold(next, opPtr) {
+			state.cast = &struc
+		}
+	case asmTypedef:
+		integer := asmInt{n: int64(token.(asmTypedef).unit.Width())}
+		integer.wordsize = uint8(wordsize)
+		state.retStack.push(integer)
+		state.opSet = &binaryOperators
+	case asmRecordField:
+		integer := asmInt{n: int64(token.(asmRecordField).shift)}
+		integer.wordsize = uint8(wordsize)
+		state.retStack.push(integer)
+		state.opSet = &binaryOperators
+	case asmDataPtr:
+		// Resolved in ToEmitTree or ToCalcTree.
+		state.struc, _ = token.(asmDataPtr).ptr.unit.(*asmStruc)
+		state.retStack.push(token)
+		state.opSet = &binaryOperators
+	case memberOperator:
+		path := string(token.(memberOperator))
+		struc := state.struc
+		if state.cast != nil {
+			struc, state.cast = state.cast, nil
+		}
+		off, member, errMember := s.memberAccess(struc, path)
+		if err = err.AddL(errMember); errMember.Severity() >= ESError {
+			return false, err
+		}
+		state.retStack.pushOp(&state.opStack, &indexOperator)
+		state.retStack.push(asmInt{n: int64(off), wordsize: uint8(wordsize)})
+		state.struc, _ = member.ptr.unit.(*asmStruc)
+		state.opSet = &binaryOperators
 	case asmExpression:
-		stream.input = string(token.(asmExpression)) + stream.input[stream.c:]
+		state.retStack.texts = append(state.retStack.texts, textExpansion{
+			name: strings.TrimSpace(stream.input[tokenPos:stream.c]),
+			text: token.(asmExpression),
+		})
+		stream.input = token.(asmExpression).Text() + stream.input[stream.c:]
 		stream.c = 0
+	case asmText:
+		err = err.AddF(ESError,
+			"%s is a %s, not an arithmetic expression: %s",
+			strings.TrimSpace(stream.input[tokenPos:stream.c]), token.Thing(), token,
+		)
 	default:
 		err = err.AddF(ESError,
 			"can't use %s in arithmetic expression", token.Thing(),
@@ -531,7 +1003,7 @@ func (s *SymMap) shuntNext(state *shuntState, stream *lexStream) (bool, ErrorLis
 func (s *SymMap) shunt(stream *lexStream, unit DataUnit) (stack *shuntStack, err ErrorList) {
 	state := shuntState{
 		opSet:    &unaryOperators,
-		retStack: shuntStack{unit: unit},
+		retStack: shuntStack{unit: unit, syms: s},
 		curUnit:  unit,
 	}
 	moreTokens := true
@@ -541,12 +1013,14 @@ func (s *SymMap) shunt(stream *lexStream, unit DataUnit) (stack *shuntStack, err
 		err = err.AddL(errShunt)
 	}
 	if err.Severity() >= ESError {
-		return nil, err
+		return nil, s.explainTexts(stream.pos, state.retStack.texts, err)
 	}
 	for top := state.opStack.peek(); top != nil; top = state.opStack.peek() {
 		state.opStack.pop()
 		if top.(*shuntOp).id == opParenL {
 			err = err.AddF(ESError, "missing a right parenthesis")
+		} else if top.(*shuntOp).id == opBracketL {
+			err = err.AddF(ESError, "missing a right bracket")
 		} else {
 			state.retStack.push(top)
 		}
@@ -564,7 +1038,7 @@ func (s *SymMap) shunt(stream *lexStream, unit DataUnit) (stack *shuntStack, err
 			)
 		}
 	}
-	return &state.retStack, err
+	return &state.retStack, s.explainTexts(stream.pos, state.retStack.texts, err)
 }
 
 // shuntData wraps shunt and ToEmitTree.
@@ -572,7 +1046,7 @@ func (s *SymMap) shuntData(stream *lexStream, unit DataUnit) (Emittable, ErrorLi
 	stack, err := s.shunt(stream, unit)
 	if err.Severity() < ESError {
 		tree, errTree := stack.ToEmitTree()
-		return tree, err.AddL(errTree)
+		return tree, s.explainTexts(stream.pos, stack.texts, err.AddL(errTree))
 	}
 	return nil, err
 }
@@ -588,6 +1062,16 @@ func (s *shuntStack) processCalcOp(op *shuntOp) (ret Calcable, err ErrorList) {
 			ret.Operands[0], err0 = s.ToCalcTree()
 			err = err.AddL(err1)
 			err = err.AddL(err0)
+			if err.Severity() >= ESError {
+				return nil, err
+			}
+			// Calc() can't fail, so we have to catch this here.
+			a, b := ret.Operands[0].Calc().n, ret.Operands[1].Calc().n
+			if (op.id == opDiv || op.id == opMod) && b == 0 {
+				return nil, err.AddF(ESError, "division by zero: %s", ret)
+			} else if overflows(op.id, a, b) {
+				return nil, err.AddF(ESError, "arithmetic overflow: %s", ret)
+			}
 			return ret, err
 		} else if op.args == 1 {
 			var err0 ErrorList
@@ -595,6 +1079,12 @@ func (s *shuntStack) processCalcOp(op *shuntOp) (ret Calcable, err ErrorList) {
 				ID: op.id, Function: op.function.(func(*asmInt)),
 			}
 			ret.Operand, err0 = s.ToCalcTree()
+			if err0.Severity() < ESError &&
+				overflows(op.id, 0, ret.Operand.Calc().n) {
+				return nil, err.AddL(err0).AddF(ESError,
+					"arithmetic overflow: %s", ret,
+				)
+			}
 			return ret, err.AddL(err0)
 		}
 	}
@@ -614,12 +1104,22 @@ func (s *shuntStack) ToCalcTree() (Calcable, ErrorList) {
 	case asmInt:
 		return root.(asmInt), err
 	case asmString:
+		// Strings used as arithmetic operands are packed into an integer
+		// of the data width, but single bytes can't hold more than one
+		// character, so the operation should decide.
 		wordsize := s.unit.Width()
+		limit := wordsize
 		if wordsize == 1 {
-			wordsize = 0
+			limit = 0
 		}
-		integer, errInteger := root.(asmString).Int(wordsize)
+		integer, errInteger := root.(asmString).Int(limit)
+		integer.wordsize = uint8(wordsize)
 		return integer, err.AddL(errInteger)
+	case asmDataPtr:
+		// Labels used as arithmetic operands evaluate to their offset.
+		integer, errOffset := offsetOf(root)
+		integer.wordsize = uint8(s.unit.Width())
+		return integer, err.AddL(errOffset)
 	}
 	return nil, err.AddF(ESError,
 		"can't use %s in arithmetic expression", root.Thing(),
@@ -677,18 +1177,43 @@ func (s *shuntStack) ToEmitTree() (Emittable, ErrorList) {
 		case opDup:
 			data, errData := s.ToEmitTree()
 			count, errCount := s.ToCalcTree()
-			dup, errDup := NewDUPOperator(count, data)
 			err = err.AddL(errData)
 			err = err.AddL(errCount)
+			if err.Severity() >= ESError {
+				return nil, err
+			}
+			dup, errDup := NewDUPOperator(count, data)
 			err = err.AddL(errDup)
 			return dup, err
+		case opPlus, opMinus:
+			switch top := s.peek(); top.(type) {
+			case asmReal:
+				if op.args != 1 {
+					break
+				}
+				s.pop()
+				real := top.(asmReal)
+				if op.id == opMinus {
+					real = real.Neg()
+				}
+				return real, err.AddL(real.checkWidth())
+			}
 		}
 		cOp, errCOp := s.processCalcOp(root.(*shuntOp))
-		return CalcToEmitOperator{cOp}, err.AddL(errCOp)
+		err = err.AddL(errCOp)
+		if errCOp.Severity() >= ESError {
+			return nil, err
+		}
+		return CalcToEmitOperator{cOp}, err.AddL(s.fitsInStack(cOp.Calc()))
 	case asmInt:
 		return root.(asmInt), err.AddL(s.fitsInStack(root.(asmInt)))
 	case asmString:
 		return root.(asmString), err
+	case asmReal:
+		return root.(asmReal), err.AddL(root.(asmReal).checkWidth())
+	case asmDataPtr:
+		address, errAddress := s.address(root.(asmDataPtr))
+		return address, err.AddL(errAddress)
 	case DataArray:
 		return root.(DataArray), err
 	}
@@ -697,13 +1222,48 @@ func (s *shuntStack) ToEmitTree() (Emittable, ErrorList) {
 	)
 }
 
-// fitsInStack returns an error if v doesn't fit into the stack's word size.
-func (s shuntStack) fitsInStack(v asmInt) ErrorList {
+// address returns the address of ptr as data of the stack's word size, which
+// is a far pointer if the word size exceeds the one of ptr's segment.
+func (s shuntStack) address(ptr asmDataPtr) (asmInt, ErrorList) {
 	wordsize := s.unit.Width()
+	ret := asmInt{n: int64(ptr.off), wordsize: uint8(wordsize)}
+	reloc := asmReloc{typ: RelocOffset, target: s.syms.ToSymCase(*ptr.ptr.sym)}
+	var err ErrorList
+	if ptr.et != nil {
+		switch offsize := uint(ptr.et.WordSize()); {
+		case wordsize == offsize+2:
+			reloc.typ = RelocFar
+		case wordsize != offsize:
+			return ret, ErrorListF(ESError,
+				"address of %s requires %d or %d bytes, not %d",
+				*ptr.ptr.sym, offsize, offsize+2, wordsize,
+			)
+		case ptr.far:
+			err = ErrorListF(ESWarning,
+				"storing only the offset of far label %s, use OFFSET if this is intended",
+				*ptr.ptr.sym,
+			)
+		}
+	}
+	ret.reloc = &reloc
+	return ret, err
+}
+
+// fitsInStack returns an error if v doesn't fit into the stack's word size,
+// and a warning if v is an offset that is truncated to a single byte.
+func (s shuntStack) fitsInStack(v asmInt) (err ErrorList) {
+	wordsize := s.unit.Width()
+	if v.reloc != nil && v.reloc.typ == RelocOffset && wordsize == 1 {
+		// The value might fit, but that's most likely a coincidence.
+		err = err.AddF(ESWarning,
+			"storing the offset of %s in a single byte, use LOW or HIGH if this is intended",
+			v.reloc.target,
+		)
+	}
 	if v.FitsIn(wordsize) {
-		return nil
+		return err
 	}
-	return ErrorListF(ESError, "number exceeds %d bits: %s", wordsize*8, v)
+	return err.AddF(ESError, "number exceeds %d bits: %s", wordsize*8, v)
 }
 
 // solveInt wraps solve and enforceIntResult.
@@ -716,13 +1276,47 @@ func (s shuntStack) solveInt() (*asmInt, ErrorList) {
 	return nil, err
 }
 
+// isExpression returns whether expr consists of operands separated by
+// operators, without checking whether the operands actually exist.
+func isExpression(pos ItemPos, expr string) bool {
+	stream := NewLexStreamAt(pos, expr)
+	operand := false
+	for stream.ignore(whitespace); stream.peek() != eof; stream.ignore(whitespace) {
+		token := stream.nextToken(shuntDelim)
+		tokenUpper := strings.ToUpper(token)
+		_, unary := unaryOperators[tokenUpper]
+		_, binary := binaryOperators[tokenUpper]
+		if len(token) == 1 && quotes.matches(token[0]) {
+			stream.nextString(charGroup{token[0]})
+			stream.next()
+		} else if token == ")" || token == "]" || (token[0] == '.' && operand) {
+			operand = true
+			continue
+		} else if unary || binary || shuntDelim.matches(token[0]) {
+			operand = false
+			continue
+		} else {
+			for i := 0; i < len(token); i++ {
+				if !isSymbolChar(token[i]) && token[i] != '.' {
+					return false
+				}
+			}
+		}
+		if operand {
+			return false
+		}
+		operand = true
+	}
+	return true
+}
+
 // evalInt wraps shunt and solveInt.
 func (s *SymMap) evalInt(pos ItemPos, expr string) (*asmInt, ErrorList) {
 	stream := NewLexStreamAt(pos, expr)
 	stack, err := s.shunt(stream, SimpleData(maxbytes))
 	if err.Severity() < ESError {
 		ret, errSolve := stack.solveInt()
-		return ret, err.AddL(errSolve)
+		return ret, s.explainTexts(pos, stack.texts, err.AddL(errSolve))
 	}
 	return nil, err
 }
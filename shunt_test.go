@@ -0,0 +1,181 @@
+package main
+
+import "testing"
+
+func TestSizeOperators(t *testing.T) {
+	src := "S STRUC\na DB ?\nb DW 3 DUP (?)\nS ENDS\n" +
+		"d segment\n" +
+		"arr dw 1, 2, 3\n" +
+		"buf db 10 dup (0), 1\n" +
+		"tbl dd 4 dup (2 dup (?))\n" +
+		"str db 'abc'\n" +
+		"inst S <>\n" +
+		"d ends\n" +
+		"s1 = sizeof arr\ns2 = size arr\nl1 = lengthof arr\nl2 = length arr\n" +
+		"s3 = sizeof buf\ns4 = size buf\nl3 = lengthof buf\nl4 = length buf\n" +
+		"s5 = size tbl\nl5 = length tbl\n" +
+		"s6 = size str\nl6 = length str\n" +
+		"s7 = sizeof S\ns8 = size inst.b\nl8 = length inst.b\n" +
+		"s9 = size S\ns10 = size dword\n" +
+		"t1 = type arr\nt2 = type buf\nt3 = type tbl\nt4 = type inst\nt5 = type word\n"
+	p, err := parseString(t, src, ParseOptions{})
+	checkErrors(t, err, ESWarning, "")
+	for name, want := range map[string]int64{
+		"s1": 6, "s2": 2, "l1": 3, "l2": 1,
+		"s3": 11, "s4": 10, "l3": 11, "l4": 10,
+		"s5": 16, "l5": 4,
+		"s6": 1, "l6": 1,
+		"s7": 7, "s8": 6, "l8": 3,
+		"s9": 7, "s10": 4,
+		"t1": 2, "t2": 1, "t3": 4, "t4": 7, "t5": 2,
+	} {
+		if got := symInt(t, p, name); got != want {
+			t.Errorf("%s = %d, want %d", name, got, want)
+		}
+	}
+
+	_, err = parseString(t, "d segment\nd ends\nx = size d\n", ParseOptions{})
+	checkErrors(t, err, ESError, "SIZE requires a type or data label")
+}
+
+func TestTypeArithmetic(t *testing.T) {
+	src := "P STRUC\nx DW ?\ny DW ?\nP ENDS\n" +
+		"d segment\narr dd 1, 2\nd ends\n" +
+		"a = DWORD * 3\nb = TYPE arr * 2\nc = P * 2\nd2 = WORD + BYTE\ne = TYPE P\n"
+	p, err := parseString(t, src, ParseOptions{})
+	checkErrors(t, err, ESWarning, "")
+	for name, want := range map[string]int64{"a": 12, "b": 8, "c": 8, "d2": 3, "e": 4} {
+		if got := symInt(t, p, name); got != want {
+			t.Errorf("%s = %d, want %d", name, got, want)
+		}
+	}
+}
+
+func TestDivisionByZero(t *testing.T) {
+	for _, expr := range []string{"1 / 0", "5 mod (2 - 2)", "x / (x - 3)"} {
+		_, err := parseString(t, "x = 3\ny = "+expr+"\n", ParseOptions{})
+		checkErrors(t, err, ESError, "division by zero")
+	}
+	src := "d segment\ndb 4 / 0\ndw (1 / 0) dup (?)\nd ends\n"
+	_, err := parseString(t, src, ParseOptions{})
+	checkErrors(t, err, ESError, "division by zero")
+	p, err := parseString(t, "y = 6 / 3\n", ParseOptions{})
+	checkErrors(t, err, ESError, "")
+	if got := symInt(t, p, "y"); got != 2 {
+		t.Errorf("y = %d, want 2", got)
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{"0x7FFFFFFFFFFFFFFF * 2", "arithmetic overflow"},
+		{"7FFFFFFFFFFFFFFFh * 2", "arithmetic overflow"},
+		{"7FFFFFFFFFFFFFFFh + 1", "arithmetic overflow"},
+		{"-7FFFFFFFFFFFFFFFh - 2", "arithmetic overflow"},
+		{"1 shl 64", "arithmetic overflow"},
+		{"7FFFFFFFFFFFFFFFh * 1", ""},
+		{"-7FFFFFFFFFFFFFFFh - 1", ""},
+		{"1 shl 63", ""},
+	}
+	for _, test := range tests {
+		_, err := parseString(t, "y = "+test.expr+"\n", ParseOptions{})
+		checkErrors(t, err, ESError, test.err)
+	}
+}
+
+func TestTextEquatesAsNumbers(t *testing.T) {
+	tests := []struct {
+		syntax, src string
+		err         string
+	}{
+		{"TASM", "x equ <1 +>\nd segment\ndw x\nd ends\n", "x is a text equate for <1 +>, which is not a number"},
+		{"MASM", "x equ <1 +>\ny = x * 2\n", "x is a text equate for <1 +>, which is not a number"},
+		{"TASM", "x equ <abc>\nd segment\ndw x\nd ends\n", "x is a text equate for <abc>, which refers to undefined symbols"},
+		{"TASM", "x equ <2 +>\ny = x 3\n", ""},
+		{"TASM", "x equ <2>\nd segment\ndw x * 3\nd ends\n", ""},
+	}
+	for _, test := range tests {
+		_, err := parseString(t, test.src, ParseOptions{Syntax: test.syntax})
+		checkErrors(t, err, ESWarning, test.err)
+	}
+}
+
+func TestExternalTypes(t *testing.T) {
+	src := "S STRUC\na DB ?\nb DW ?\nS ENDS\n" +
+		"extrn buf:dword, w:word, v:S, n:abs\nextern e:byte\n" +
+		"t1 = type buf\ns1 = size buf\nt2 = type w\nt3 = type v\ns3 = size v\nt4 = type n\nt5 = type e\n"
+	p, err := parseString(t, src, ParseOptions{})
+	checkErrors(t, err, ESWarning, "")
+	for name, want := range map[string]int64{
+		"t1": 4, "s1": 4, "t2": 2, "t3": 3, "s3": 3, "t4": 0, "t5": 1,
+	} {
+		if got := symInt(t, p, name); got != want {
+			t.Errorf("%s = %d, want %d", name, got, want)
+		}
+	}
+}
+
+func TestMultiTokenEquates(t *testing.T) {
+	src := "fmt equ <%d bytes free>\nmsg equ hello world\n"
+	p, err := parseString(t, src, ParseOptions{})
+	checkErrors(t, err, ESWarning, "")
+	for name, want := range map[string]string{"fmt": "%d bytes free", "msg": "hello world"} {
+		if got, err := p.text("%" + name); got != want || err.Severity() >= ESWarning {
+			t.Errorf("%%%s = %q, want %q\n%s", name, got, want, errorsString(err))
+		}
+	}
+
+	for use, want := range map[string]string{
+		"x = fmt + 1\n":               "fmt is a text macro, not an arithmetic expression: <%d bytes free>",
+		"d segment\ndw msg\nd ends\n": "msg is a text macro, not an arithmetic expression: <hello world>",
+	} {
+		_, err := parseString(t, src+use, ParseOptions{})
+		checkErrors(t, err, ESError, want)
+	}
+}
+
+func TestNearFarSizes(t *testing.T) {
+	tests := []struct {
+		src       string
+		wordsize  uint8
+		near, far int64
+	}{
+		{"", 0, 2, 4},
+		{".model small\n", 0, 2, 4},
+		{"", 4, 4, 6},
+		{".386\n", 0, 4, 6},
+		{".386\n.model flat\n", 0, 4, 6},
+	}
+	for _, test := range tests {
+		src := test.src + "n = TYPE NEAR\nf = TYPE FAR\ns = SIZE NEAR\n"
+		p, err := parseString(t, src, ParseOptions{WordSize: test.wordsize})
+		checkErrors(t, err, ESWarning, "")
+		for name, want := range map[string]int64{"n": test.near, "f": test.far, "s": test.near} {
+			if got := symInt(t, p, name); got != want {
+				t.Errorf("%q: %s = %d, want %d", test.src, name, got, want)
+			}
+		}
+	}
+}
+
+func TestOffsetOperands(t *testing.T) {
+	tests := []struct {
+		src string
+		err string
+	}{
+		{"x = offset\n", "OFFSET requires an operand"},
+		{"x = offset   \n", "OFFSET requires an operand"},
+		{"x = 1 + (offset)\n", "OFFSET requires an operand"},
+		{"d segment\ndw offset\nd ends\n", "OFFSET requires an operand"},
+		{"d segment\ndw offset, 1\nd ends\n", "OFFSET requires an operand"},
+		{"x = size\n", "SIZE requires an operand"},
+		{"x = offset 5\n", "OFFSET requires an addressable operand, not integer"},
+	}
+	for _, test := range tests {
+		_, err := parseString(t, test.src, ParseOptions{})
+		checkErrors(t, err, ESError, test.err)
+	}
+}
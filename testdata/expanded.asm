@@ -0,0 +1,29 @@
+DEBUG = 0
+
+PUSHALL MACRO regs
+	IRP r, <regs>
+	push r
+	ENDM
+ENDM
+
+CODE SEGMENT
+start:
+	PUSHALL <ax, bx, cx>
+IF DEBUG
+	int 3
+ELSE
+	nop
+ENDIF
+	REPT 2
+	inc ax
+	ENDM
+	ret
+CODE ENDS
+
+DATA SEGMENT
+	INCLUDE expanded.inc
+IFDEF INCLUDED
+	DB 1
+ENDIF
+DATA ENDS
+	END start
@@ -0,0 +1,19 @@
+POINT STRUC
+x	DW ?
+y	DW ?
+POINT ENDS
+
+DATA SEGMENT
+msg	DB 'hello', 13, 10
+msglen	= $ - msg
+	DB 0
+table	DW 1, 2, 3, 4
+origin	POINT <>
+points	POINT 3 DUP (<1, 2>)
+DATA ENDS
+
+BSS SEGMENT
+buf	DB 256 DUP (?)
+count	DD ?
+BSS ENDS
+	END